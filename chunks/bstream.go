@@ -0,0 +1,160 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Based on the Facebook Gorilla paper: http://www.vldb.org/pvldb/vol8/p1816-teller.pdf
+
+package chunks
+
+import "io"
+
+// bstream is a stream of bits, backed by a byte slice. It supports writing
+// and reading individual bits as well as whole bytes.
+type bstream struct {
+	stream []byte
+	count  uint8 // number of unused bits in the tail byte
+}
+
+func (b *bstream) bytes() []byte {
+	return b.stream
+}
+
+type bit bool
+
+const (
+	zero bit = false
+	one  bit = true
+)
+
+func (b *bstream) writeBit(bt bit) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+
+	i := len(b.stream) - 1
+
+	if bt {
+		b.stream[i] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+
+	i := len(b.stream) - 1
+
+	b.stream[i] |= byt >> (8 - b.count)
+
+	b.stream = append(b.stream, 0)
+	i++
+	b.stream[i] = byt << b.count
+}
+
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		byt := byte(u >> 56)
+		b.writeByte(byt)
+		u <<= 8
+		nbits -= 8
+	}
+
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+// bstreamReader reads bits sequentially from a bstream's byte slice.
+type bstreamReader struct {
+	stream []byte
+	idx    int // index into stream of the next byte to read
+
+	buffer uint64 // unread bits, right-aligned
+	valid  uint8  // number of valid (unread) bits in buffer
+}
+
+func newBReader(b []byte) bstreamReader {
+	return bstreamReader{stream: b}
+}
+
+func (b *bstreamReader) readBit() (bit, error) {
+	if b.valid == 0 {
+		if !b.loadNextByte() {
+			return false, io.EOF
+		}
+	}
+	b.valid--
+	bitv := (b.buffer >> b.valid) & 1
+	return bitv != 0, nil
+}
+
+// ReadByte implements io.ByteReader so the reader can be used directly with
+// encoding/binary's varint helpers.
+func (b *bstreamReader) ReadByte() (byte, error) {
+	return b.readBits(8)
+}
+
+func (b *bstreamReader) readBits(nbits uint8) (byte, error) {
+	var v uint64
+	for nbits > 0 {
+		if b.valid == 0 {
+			if !b.loadNextByte() {
+				return 0, io.EOF
+			}
+		}
+		n := nbits
+		if n > b.valid {
+			n = b.valid
+		}
+
+		v <<= n
+		v |= uint64(b.buffer>>(b.valid-n)) & ((1 << n) - 1)
+
+		b.valid -= n
+		nbits -= n
+	}
+	return byte(v), nil
+}
+
+func (b *bstreamReader) readBitsN(nbits int) (uint64, error) {
+	var v uint64
+	for nbits > 0 {
+		n := uint8(nbits)
+		if n > 8 {
+			n = 8
+		}
+		byt, err := b.readBits(n)
+		if err != nil {
+			return 0, err
+		}
+		v = (v << n) | uint64(byt)
+		nbits -= int(n)
+	}
+	return v, nil
+}
+
+func (b *bstreamReader) loadNextByte() bool {
+	if b.idx >= len(b.stream) {
+		return false
+	}
+	b.buffer = uint64(b.stream[b.idx])
+	b.valid = 8
+	b.idx++
+	return true
+}
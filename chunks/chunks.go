@@ -0,0 +1,86 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chunks implements the on-disk sample encodings used by the head
+// and persisted blocks.
+package chunks
+
+import "fmt"
+
+// Encoding is the identifier for a chunk encoding.
+type Encoding uint8
+
+// The known chunk encodings.
+const (
+	EncNone Encoding = iota
+	EncXOR
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncNone:
+		return "none"
+	case EncXOR:
+		return "XOR"
+	}
+	return "<unknown>"
+}
+
+// Chunk holds a sequence of sample pairs encoded in a byte slice.
+type Chunk interface {
+	// Bytes returns the underlying byte slice of the chunk.
+	Bytes() []byte
+	// Encoding returns the encoding of the chunk.
+	Encoding() Encoding
+	// Appender returns an appender to append samples to the chunk.
+	Appender() (Appender, error)
+	// Iterator returns an iterator over the samples in the chunk.
+	Iterator() Iterator
+	// NumSamples returns the number of samples in the chunk.
+	NumSamples() int
+}
+
+// Appender adds sample pairs to a chunk.
+type Appender interface {
+	Append(t int64, v float64)
+}
+
+// Iterator iterates over the sample pairs of a chunk in order.
+type Iterator interface {
+	// Next advances the iterator and returns true if another pair was
+	// found.
+	Next() bool
+	// At returns the current sample pair.
+	At() (t int64, v float64)
+	// Err returns the last error of the iterator.
+	Err() error
+}
+
+// FromData returns a Chunk for the given encoding and on-disk
+// representation.
+func FromData(e Encoding, d []byte) (Chunk, error) {
+	switch e {
+	case EncXOR:
+		return &XORChunk{b: &bstream{stream: d, count: 0}}, nil
+	}
+	return nil, fmt.Errorf("unknown chunk encoding: %d", e)
+}
+
+// NewEmptyChunk returns an empty chunk for the given encoding.
+func NewEmptyChunk(e Encoding) (Chunk, error) {
+	switch e {
+	case EncXOR:
+		return NewXORChunk(), nil
+	}
+	return nil, fmt.Errorf("unknown chunk encoding: %d", e)
+}
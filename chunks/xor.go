@@ -0,0 +1,339 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Based on the Facebook Gorilla paper: http://www.vldb.org/pvldb/vol8/p1816-teller.pdf
+
+package chunks
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// XORChunk holds XOR encoded sample data, as described in the Gorilla paper.
+// The first two bytes hold the number of samples; the rest is a bit stream
+// of timestamp/value deltas.
+type XORChunk struct {
+	b *bstream
+}
+
+// NewXORChunk returns a new empty XOR encoded chunk.
+func NewXORChunk() *XORChunk {
+	b := make([]byte, 2, 128)
+	return &XORChunk{b: &bstream{stream: b, count: 0}}
+}
+
+// Encoding implements Chunk.
+func (c *XORChunk) Encoding() Encoding {
+	return EncXOR
+}
+
+// Bytes implements Chunk.
+func (c *XORChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+// NumSamples implements Chunk.
+func (c *XORChunk) NumSamples() int {
+	return int(binary.BigEndian.Uint16(c.b.bytes()))
+}
+
+// Appender implements Chunk. Samples already present in the chunk are
+// replayed once to recover the encoder state, then further samples are
+// appended to the existing bit stream.
+func (c *XORChunk) Appender() (Appender, error) {
+	it := c.iterator()
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	a := &xorAppender{
+		b:        c.b,
+		t:        it.t,
+		v:        it.val,
+		tDelta:   it.tDelta,
+		leading:  it.leading,
+		trailing: it.trailing,
+	}
+	if it.numRead == 0 {
+		a.leading = 0xff
+	}
+	return a, nil
+}
+
+// Iterator implements Chunk.
+func (c *XORChunk) Iterator() Iterator {
+	return c.iterator()
+}
+
+func (c *XORChunk) iterator() *xorIterator {
+	return &xorIterator{
+		br:       newBReader(c.b.bytes()[2:]),
+		numTotal: binary.BigEndian.Uint16(c.b.bytes()),
+	}
+}
+
+type xorAppender struct {
+	b *bstream
+
+	t      int64
+	v      float64
+	tDelta uint64
+
+	leading  uint8
+	trailing uint8
+}
+
+func (a *xorAppender) Append(t int64, v float64) {
+	var tDelta uint64
+	num := binary.BigEndian.Uint16(a.b.bytes())
+
+	switch num {
+	case 0:
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, byt := range buf[:binary.PutVarint(buf, t)] {
+			a.b.writeByte(byt)
+		}
+		a.b.writeBits(math.Float64bits(v), 64)
+
+	case 1:
+		tDelta = uint64(t - a.t)
+
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, byt := range buf[:binary.PutUvarint(buf, tDelta)] {
+			a.b.writeByte(byt)
+		}
+		a.writeVDelta(v)
+
+	default:
+		tDelta = uint64(t - a.t)
+		dod := int64(tDelta - a.tDelta)
+
+		switch {
+		case dod == 0:
+			a.b.writeBit(zero)
+		case bitRange(dod, 14):
+			a.b.writeBits(0x02, 2)
+			a.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			a.b.writeBits(0x06, 3)
+			a.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			a.b.writeBits(0x0e, 4)
+			a.b.writeBits(uint64(dod), 20)
+		default:
+			a.b.writeBits(0x0f, 4)
+			a.b.writeBits(uint64(dod), 64)
+		}
+		a.writeVDelta(v)
+	}
+
+	a.t = t
+	a.v = v
+	a.tDelta = tDelta
+	num++
+	binary.BigEndian.PutUint16(a.b.bytes(), num)
+}
+
+func bitRange(x int64, nbits uint) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+func (a *xorAppender) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(a.v)
+
+	if vDelta == 0 {
+		a.b.writeBit(zero)
+		return
+	}
+	a.b.writeBit(one)
+
+	leading := uint8(bits.LeadingZeros64(vDelta))
+	trailing := uint8(bits.TrailingZeros64(vDelta))
+
+	// Clamp number of leading zeros to avoid overflow when encoding.
+	if leading >= 32 {
+		leading = 31
+	}
+
+	if a.leading != 0xff && leading >= a.leading && trailing >= a.trailing {
+		a.b.writeBit(zero)
+		a.b.writeBits(vDelta>>a.trailing, 64-int(a.leading)-int(a.trailing))
+	} else {
+		a.leading, a.trailing = leading, trailing
+
+		a.b.writeBit(one)
+		a.b.writeBits(uint64(leading), 5)
+
+		sigbits := 64 - leading - trailing
+		a.b.writeBits(uint64(sigbits), 6)
+		a.b.writeBits(vDelta>>trailing, int(sigbits))
+	}
+}
+
+type xorIterator struct {
+	br       bstreamReader
+	numTotal uint16
+	numRead  uint16
+
+	t   int64
+	val float64
+
+	leading  uint8
+	trailing uint8
+
+	tDelta uint64
+	err    error
+}
+
+func (it *xorIterator) At() (int64, float64) {
+	return it.t, it.val
+}
+
+func (it *xorIterator) Err() error {
+	return it.err
+}
+
+func (it *xorIterator) Next() bool {
+	if it.err != nil || it.numRead == it.numTotal {
+		return false
+	}
+
+	if it.numRead == 0 {
+		t, err := binary.ReadVarint(&it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.br.readBitsN(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t = t
+		it.val = math.Float64frombits(v)
+
+		it.numRead++
+		return true
+	}
+	if it.numRead == 1 {
+		tDelta, err := binary.ReadUvarint(&it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.tDelta = tDelta
+		it.t = it.t + int64(it.tDelta)
+
+		return it.readValue()
+	}
+
+	var d byte
+	// Read the varint dod control bits: 0, 10, 110, 1110, or 1111.
+	for i := 0; i < 4; i++ {
+		d <<= 1
+		bt, err := it.br.readBit()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if bt == zero {
+			break
+		}
+		d |= 1
+	}
+	var sz uint8
+	var dod int64
+	switch d {
+	case 0x00:
+		// dod == 0
+	case 0x02:
+		sz = 14
+	case 0x06:
+		sz = 17
+	case 0x0e:
+		sz = 20
+	case 0x0f:
+		bits, err := it.br.readBitsN(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		dod = int64(bits)
+	}
+
+	if sz != 0 {
+		bitsv, err := it.br.readBitsN(int(sz))
+		if err != nil {
+			it.err = err
+			return false
+		}
+		dod = int64(bitsv)
+		if bitsv > (1 << (sz - 1)) {
+			dod -= 1 << sz
+		}
+	}
+
+	it.tDelta = uint64(int64(it.tDelta) + dod)
+	it.t = it.t + int64(it.tDelta)
+
+	return it.readValue()
+}
+
+func (it *xorIterator) readValue() bool {
+	bt, err := it.br.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if bt == zero {
+		// Value unchanged.
+	} else {
+		bt, err := it.br.readBit()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if bt != zero {
+			leading, err := it.br.readBitsN(5)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.leading = uint8(leading)
+
+			sigbits, err := it.br.readBitsN(6)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.trailing = 64 - it.leading - uint8(sigbits)
+		}
+
+		sigbits := 64 - it.leading - it.trailing
+		bitsv, err := it.br.readBitsN(int(sigbits))
+		if err != nil {
+			it.err = err
+			return false
+		}
+		vbits := math.Float64bits(it.val)
+		vbits ^= bitsv << it.trailing
+		it.val = math.Float64frombits(vbits)
+	}
+
+	it.numRead++
+	return true
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestXORChunk(t *testing.T) {
+	c := NewXORChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+
+	ts := int64(1000)
+	var exp [][2]interface{}
+
+	for i := 0; i < 300; i++ {
+		ts += int64(rand.Intn(10000))
+		v := rand.Float64()
+		app.Append(ts, v)
+		exp = append(exp, [2]interface{}{ts, v})
+	}
+
+	require.Equal(t, len(exp), c.NumSamples())
+
+	it := c.Iterator()
+	for i, e := range exp {
+		require.True(t, it.Next(), "sample %d", i)
+		gt, gv := it.At()
+		require.Equal(t, e[0], gt)
+		require.Equal(t, e[1], gv)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
+
+func TestXORChunkAppendAfterReopen(t *testing.T) {
+	c := NewXORChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+	app.Append(1, 1)
+	app.Append(2, 2)
+
+	c2, err := FromData(EncXOR, c.Bytes())
+	require.NoError(t, err)
+
+	app2, err := c2.Appender()
+	require.NoError(t, err)
+	app2.Append(3, 3)
+
+	it := c2.Iterator()
+	var got []int64
+	for it.Next() {
+		t, _ := it.At()
+		got = append(got, t)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []int64{1, 2, 3}, got)
+}
@@ -0,0 +1,289 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// ErrNotFound is returned when a series reference does not resolve to a
+// series known to the head, e.g. because it belongs to a stale generation.
+var ErrNotFound = errors.New("not found")
+
+// ErrThrottled is returned by Add/AddFast when RateLimitMode is
+// RateLimitThrottle and the ingestion rate limit has been exceeded.
+var ErrThrottled = errors.New("throttled: sample rate limit exceeded")
+
+// Logger is the minimal logging interface DB accepts. A nil Logger disables
+// logging.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// RateLimitMode controls how Appender.Add/AddFast behave once the ingest
+// rate limit configured by Options.SamplesPerSecond/Burst is exhausted.
+type RateLimitMode int
+
+const (
+	// RateLimitDisabled accepts every sample unconditionally; this is the
+	// zero value, so a zero Options behaves exactly as before rate
+	// limiting existed.
+	RateLimitDisabled RateLimitMode = iota
+	// RateLimitBlock blocks the caller until a token is available or its
+	// context is canceled.
+	RateLimitBlock
+	// RateLimitThrottle fails fast with ErrThrottled instead of blocking.
+	RateLimitThrottle
+)
+
+// Options of the DB storage.
+type Options struct {
+	// RateLimitMode selects how ingestion behaves once the rate limit
+	// below is exhausted. Defaults to RateLimitDisabled.
+	RateLimitMode RateLimitMode
+	// SamplesPerSecond is the steady-state token-bucket refill rate used
+	// when RateLimitMode is not RateLimitDisabled.
+	SamplesPerSecond float64
+	// Burst is the token-bucket capacity, i.e. how far ingestion may
+	// exceed SamplesPerSecond momentarily.
+	Burst int
+}
+
+// Appender allows appending a batch of data. It must be completed with a
+// call to Commit or Rollback and must not be reused afterwards.
+//
+// Operations on the Appender interface are not goroutine-safe.
+type Appender interface {
+	// Add adds a sample pair for the given series. A reference number is
+	// returned which can be used to add further samples via AddFast. If
+	// rate limiting is configured with RateLimitBlock, this blocks on the
+	// DB's own lifetime context -- it is only canceled by DB.Close. Use
+	// AddCtx to bound an individual call instead.
+	Add(l labels.Labels, t int64, v float64) (uint64, error)
+
+	// AddCtx is Add, but a blocking rate-limit wait is canceled when ctx
+	// is done (in addition to the DB being closed), returning ctx.Err().
+	AddCtx(ctx context.Context, l labels.Labels, t int64, v float64) (uint64, error)
+
+	// AddFast adds a sample pair for the referenced series. See Add's
+	// docs for its rate-limit blocking behavior.
+	AddFast(ref uint64, t int64, v float64) error
+
+	// AddFastCtx is AddFast, but a blocking rate-limit wait is canceled
+	// when ctx is done. See AddCtx.
+	AddFastCtx(ctx context.Context, ref uint64, t int64, v float64) error
+
+	// Commit submits the collected samples and purges the batch.
+	Commit() error
+
+	// Rollback cancels the batch and purges it.
+	Rollback() error
+}
+
+// DB handles reads and writes of time series falling into a time window of
+// a single disk directory.
+type DB struct {
+	mtx sync.Mutex
+
+	dir    string
+	logger Logger
+	opts   *Options
+
+	head *Head
+
+	limiter *RateLimiter
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// Open returns a new DB in the given directory.
+func Open(dir string, l Logger, r interface{}, opts *Options) (db *DB, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	db = &DB{
+		dir:    dir,
+		logger: l,
+		opts:   opts,
+		head:   NewHead(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if opts.RateLimitMode != RateLimitDisabled {
+		db.limiter = NewRateLimiter(opts.SamplesPerSecond, opts.Burst)
+	}
+	return db, nil
+}
+
+// Close the database. All data that is not yet persisted is lost.
+func (db *DB) Close() error {
+	db.cancel()
+	if db.limiter != nil {
+		db.limiter.Close()
+	}
+	return nil
+}
+
+// IngestStats returns an EMA of the current sample ingestion rate
+// (samples/s) and the corresponding estimated byte rate, suitable for
+// exposing as Prometheus gauges. Both are zero when rate limiting is
+// disabled.
+func (db *DB) IngestStats() (rate, bytes float64) {
+	if db.limiter == nil {
+		return 0, 0
+	}
+	return db.limiter.Stats()
+}
+
+// dbAppender wraps the head's appender, tracks how many samples were added
+// through it so it can be surfaced for metrics and tests, and enforces the
+// DB's ingestion rate limit, if any.
+type dbAppender struct {
+	*headAppender
+
+	db      *DB
+	samples int
+
+	// tokens is how many rate-limit tokens this batch has taken so far.
+	// Rollback returns them to the limiter; Commit leaves them spent.
+	tokens int
+}
+
+// Appender opens a new appender against the database.
+func (db *DB) Appender() Appender {
+	return &dbAppender{
+		headAppender: db.head.Appender().(*headAppender),
+		db:           db,
+	}
+}
+
+func (a *dbAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	return a.AddCtx(a.db.ctx, l, t, v)
+}
+
+func (a *dbAppender) AddCtx(ctx context.Context, l labels.Labels, t int64, v float64) (uint64, error) {
+	if err := a.db.acquireToken(ctx); err != nil {
+		return 0, err
+	}
+	ref, err := a.headAppender.AddCtx(ctx, l, t, v)
+	if err != nil {
+		a.db.releaseTokens(1)
+		return 0, err
+	}
+	a.samples++
+	a.tokens++
+	return ref, nil
+}
+
+func (a *dbAppender) AddFast(ref uint64, t int64, v float64) error {
+	return a.AddFastCtx(a.db.ctx, ref, t, v)
+}
+
+func (a *dbAppender) AddFastCtx(ctx context.Context, ref uint64, t int64, v float64) error {
+	if err := a.db.acquireToken(ctx); err != nil {
+		return err
+	}
+	if err := a.headAppender.AddFastCtx(ctx, ref, t, v); err != nil {
+		a.db.releaseTokens(1)
+		return err
+	}
+	a.samples++
+	a.tokens++
+	return nil
+}
+
+// Rollback returns any tokens this batch took before discarding it.
+func (a *dbAppender) Rollback() error {
+	if a.tokens > 0 {
+		a.db.releaseTokens(a.tokens)
+		a.tokens = 0
+	}
+	return a.headAppender.Rollback()
+}
+
+// acquireToken consults the DB's rate limiter, if configured, blocking or
+// failing fast per opts.RateLimitMode. A RateLimitBlock wait is canceled by
+// either ctx or the DB's own lifetime context, whichever comes first.
+func (db *DB) acquireToken(ctx context.Context) error {
+	if db.limiter == nil {
+		return nil
+	}
+	switch db.opts.RateLimitMode {
+	case RateLimitThrottle:
+		if !db.limiter.tryTake(1) {
+			return ErrThrottled
+		}
+		return nil
+	case RateLimitBlock:
+		if db.limiter.tryTake(1) {
+			// Tokens were available; the common case for a caller well
+			// within its rate doesn't need the merged-context machinery
+			// below at all.
+			return nil
+		}
+		if ctx == nil {
+			ctx = db.ctx
+		} else if ctx != db.ctx {
+			var cancel context.CancelFunc
+			ctx, cancel = contextWithParent(ctx, db.ctx)
+			defer cancel()
+		}
+		return db.limiter.wait(ctx, 1)
+	}
+	return nil
+}
+
+// contextWithParent returns a context that is done when either ctx or
+// parent is done, so a per-call Add/AddFast context can bound a blocking
+// rate-limit wait without weakening the DB-lifetime cancellation that
+// already applied to it.
+func contextWithParent(ctx, parent context.Context) (context.Context, context.CancelFunc) {
+	merged, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-parent.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+	return merged, func() {
+		close(stop)
+		cancel()
+	}
+}
+
+func (db *DB) releaseTokens(n int) {
+	if db.limiter == nil {
+		return
+	}
+	db.limiter.release(float64(n))
+}
+
+// Querier returns a new querier over the data partition for the given time
+// range.
+func (db *DB) Querier(mint, maxt int64) Querier {
+	return db.head.Querier(mint, maxt)
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSelectNegationMatchers mirrors TestDataAvailableOnlyAfterCommit but
+// exercises the postings-accelerated paths for != and !~ added to
+// Querier.Select.
+func TestSelectNegationMatchers(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("foo", "baz"), 0, 1)
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("foo", "other"), 0, 2)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	querier := db.Querier(0, 1)
+	defer querier.Close()
+
+	seriesSet, err := readSeriesSet(querier.Select(labels.NewNotEqualMatcher("foo", "bar")))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]sample{
+		`{foo="baz"}`:   {{t: 0, v: 1}},
+		`{foo="other"}`: {{t: 0, v: 2}},
+	}, seriesSet)
+
+	re, err := labels.NewNotRegexpMatcher("foo", "ba.")
+	require.NoError(t, err)
+
+	seriesSet, err = readSeriesSet(querier.Select(re))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]sample{
+		`{foo="other"}`: {{t: 0, v: 2}},
+	}, seriesSet)
+}
+
+// TestSelectEqualEmptyValueMatchesMissingLabel guards against a regression
+// where postingsForMatcher trusted head.postings.get(name, "") to resolve
+// the standard "label is absent" matcher, but memPostings never holds a
+// {name: ""} entry -- the lookup always came back empty, so Select with an
+// Equal(name, "") matcher silently matched nothing instead of falling back
+// to the per-series scan every other unaccelerated matcher gets.
+func TestSelectEqualEmptyValueMatchesMissingLabel(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("foo", "bar", "env", "prod"), 0, 1)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	querier := db.Querier(0, 1)
+	defer querier.Close()
+
+	seriesSet, err := readSeriesSet(querier.Select(labels.NewEqualMatcher("env", "")))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]sample{
+		`{foo="bar"}`: {{t: 0, v: 0}},
+	}, seriesSet)
+
+	seriesSet, err = readSeriesSet(querier.Select(labels.NewNotEqualMatcher("env", "")))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]sample{
+		`{env="prod",foo="bar"}`: {{t: 0, v: 1}},
+	}, seriesSet)
+}
+
+// TestSelectMultipleAcceleratedMatchers passes two matchers that both
+// resolve to postings, so matchedSeries intersects them -- regex/negation
+// matchers resolve to a *mergedPostings or *removedPostings, and
+// Intersect-ing one of those with another accelerated operand is the path
+// that used to hang forever (see the Seek/At contract fix in
+// postings.go). A single accelerated matcher never exercises this, since
+// Intersect short-circuits for one operand.
+func TestSelectMultipleAcceleratedMatchers(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("job", "x", "instance", "foo1"), 0, 0)
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("job", "x", "instance", "foo2"), 0, 1)
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("job", "x", "instance", "bar1"), 0, 2)
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("job", "y", "instance", "foo3"), 0, 3)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	querier := db.Querier(0, 1)
+	defer querier.Close()
+
+	instanceRe, err := labels.NewRegexpMatcher("instance", "foo.*")
+	require.NoError(t, err)
+
+	done := make(chan map[string][]sample, 1)
+	go func() {
+		seriesSet, err := readSeriesSet(querier.Select(labels.NewEqualMatcher("job", "x"), instanceRe))
+		require.NoError(t, err)
+		done <- seriesSet
+	}()
+
+	select {
+	case seriesSet := <-done:
+		require.Equal(t, map[string][]sample{
+			`{instance="foo1",job="x"}`: {{t: 0, v: 0}},
+			`{instance="foo2",job="x"}`: {{t: 0, v: 1}},
+		}, seriesSet)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Select with two accelerated matchers did not terminate")
+	}
+
+	jobNeq := labels.NewNotEqualMatcher("job", "y")
+
+	done = make(chan map[string][]sample, 1)
+	go func() {
+		seriesSet, err := readSeriesSet(querier.Select(jobNeq, instanceRe))
+		require.NoError(t, err)
+		done <- seriesSet
+	}()
+
+	select {
+	case seriesSet := <-done:
+		require.Equal(t, map[string][]sample{
+			`{instance="foo1",job="x"}`: {{t: 0, v: 0}},
+			`{instance="foo2",job="x"}`: {{t: 0, v: 1}},
+		}, seriesSet)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Select with a negation and a regexp matcher did not terminate")
+	}
+}
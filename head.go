@@ -0,0 +1,237 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// seriesRefGenBits is the width, in bits, of the head generation field packed
+// into the high end of a series reference. The remaining low bits hold the
+// series ID. Generation 0 and 1 are reserved so that a zero-valued ref is
+// never mistaken for a live series.
+const seriesRefGenBits = 40
+
+// initialHeadGeneration is the generation assigned to the first head a DB
+// opens. Generations below it are never issued, so any ref bearing one is
+// known to be stale.
+const initialHeadGeneration = 2
+
+func packSeriesRef(generation uint8, id uint32) uint64 {
+	return uint64(generation)<<seriesRefGenBits | uint64(id)
+}
+
+func unpackSeriesRef(ref uint64) (generation uint8, id uint32) {
+	return uint8(ref >> seriesRefGenBits), uint32(ref & ((1 << seriesRefGenBits) - 1))
+}
+
+// Head is an in-memory block that can be directly appended to and queried.
+type Head struct {
+	mtx sync.RWMutex
+
+	generation uint8
+	nextID     uint32
+
+	series   map[uint32]*memSeries
+	hashes   map[uint64][]*memSeries
+	postings *memPostings
+}
+
+// NewHead returns a new empty head block.
+func NewHead() *Head {
+	return &Head{
+		generation: initialHeadGeneration,
+		series:     map[uint32]*memSeries{},
+		hashes:     map[uint64][]*memSeries{},
+		postings:   newMemPostings(),
+	}
+}
+
+// memSeries holds the in-memory state, including the encoded samples, for a
+// single series.
+type memSeries struct {
+	mtx sync.RWMutex
+
+	id   uint32
+	lset labels.Labels
+
+	chunk      *chunks.XORChunk
+	app        chunks.Appender
+	mint, maxt int64
+}
+
+// getOrCreate returns the series for lset, creating it if it doesn't exist
+// yet. The returned bool reports whether the series was newly created.
+func (h *Head) getOrCreate(hash uint64, lset labels.Labels) (*memSeries, bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for _, s := range h.hashes[hash] {
+		if s.lset.Equal(lset) {
+			return s, false
+		}
+	}
+
+	h.nextID++
+	s := &memSeries{id: h.nextID, lset: lset}
+
+	h.series[s.id] = s
+	h.hashes[hash] = append(h.hashes[hash], s)
+
+	return s, true
+}
+
+func (h *Head) seriesByID(id uint32) *memSeries {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return h.series[id]
+}
+
+// Appender returns a new Appender against the head.
+func (h *Head) Appender() Appender {
+	return &headAppender{head: h, generation: h.generation}
+}
+
+type pendingSample struct {
+	series *memSeries
+	t      int64
+	v      float64
+}
+
+// headAppender buffers samples until Commit is called, at which point they
+// become visible to queriers.
+type headAppender struct {
+	head       *Head
+	generation uint8
+
+	pending   []pendingSample
+	newSeries []*memSeries
+}
+
+func (a *headAppender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
+	return a.AddCtx(context.Background(), lset, t, v)
+}
+
+// AddCtx is identical to Add; the head itself never blocks on ctx, but the
+// method exists so headAppender satisfies Appender -- DB's appender is the
+// one that actually waits on ctx, for its rate limiter.
+func (a *headAppender) AddCtx(ctx context.Context, lset labels.Labels, t int64, v float64) (uint64, error) {
+	s, created := a.head.getOrCreate(lset.Hash(), lset)
+	if created {
+		a.newSeries = append(a.newSeries, s)
+	}
+	a.pending = append(a.pending, pendingSample{series: s, t: t, v: v})
+
+	return packSeriesRef(a.generation, s.id), nil
+}
+
+func (a *headAppender) AddFast(ref uint64, t int64, v float64) error {
+	return a.AddFastCtx(context.Background(), ref, t, v)
+}
+
+// AddFastCtx is identical to AddFast; see AddCtx for why ctx is unused here.
+func (a *headAppender) AddFastCtx(ctx context.Context, ref uint64, t int64, v float64) error {
+	gen, id := unpackSeriesRef(ref)
+	if gen != a.generation {
+		return fmt.Errorf("%w: reference is from a stale head generation", ErrNotFound)
+	}
+	s := a.head.seriesByID(id)
+	if s == nil {
+		return ErrNotFound
+	}
+	a.pending = append(a.pending, pendingSample{series: s, t: t, v: v})
+	return nil
+}
+
+func (a *headAppender) Commit() error {
+	a.head.mtx.Lock()
+	for _, s := range a.newSeries {
+		a.head.postings.add(s.id, s.lset)
+	}
+	a.head.mtx.Unlock()
+
+	for _, ps := range a.pending {
+		if err := ps.series.append(ps.t, ps.v); err != nil {
+			return err
+		}
+	}
+	a.pending = nil
+	a.newSeries = nil
+	return nil
+}
+
+func (a *headAppender) Rollback() error {
+	a.pending = nil
+	a.newSeries = nil
+	return nil
+}
+
+func (s *memSeries) append(t int64, v float64) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.chunk == nil {
+		s.chunk = chunks.NewXORChunk()
+		app, err := s.chunk.Appender()
+		if err != nil {
+			return err
+		}
+		s.app = app
+		s.mint = t
+	}
+	s.app.Append(t, v)
+	s.maxt = t
+	return nil
+}
+
+// chunkMeta returns an immutable snapshot of the series' current chunk, if
+// it has any samples yet. The returned bytes are a defensive copy, so later
+// appends to the live chunk -- which may grow its backing array in place --
+// can never be observed through it.
+func (s *memSeries) chunkMeta() (ChunkMeta, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.chunk == nil {
+		return ChunkMeta{}, false
+	}
+	data := append([]byte(nil), s.chunk.Bytes()...)
+	return ChunkMeta{
+		MinTime:  s.mint,
+		MaxTime:  s.maxt,
+		Encoding: s.chunk.Encoding(),
+		Chunk:    data,
+	}, true
+}
+
+func (s *memSeries) iterator() chunks.Iterator {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.chunk == nil {
+		return nopIterator{}
+	}
+	return s.chunk.Iterator()
+}
+
+type nopIterator struct{}
+
+func (nopIterator) Next() bool           { return false }
+func (nopIterator) At() (int64, float64) { return 0, 0 }
+func (nopIterator) Err() error           { return nil }
@@ -0,0 +1,131 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package labels provides the Label and Labels types used to identify
+// series, plus the Matcher interface used to select them.
+package labels
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Label is a key/value pair of strings.
+type Label struct {
+	Name, Value string
+}
+
+// Labels is a sorted set of labels. Order has to be guaranteed upon
+// instantiation.
+type Labels []Label
+
+func (ls Labels) Len() int           { return len(ls) }
+func (ls Labels) Swap(i, j int)      { ls[i], ls[j] = ls[j], ls[i] }
+func (ls Labels) Less(i, j int) bool { return ls[i].Name < ls[j].Name }
+
+// String returns a human readable representation of the label set, in the
+// same form as it is exposed over the Prometheus API, e.g. `{foo="bar"}`.
+func (ls Labels) String() string {
+	var b bytes.Buffer
+
+	b.WriteByte('{')
+	for i, l := range ls {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Get returns the value for the label with the given name. Returns an empty
+// string if the label doesn't exist.
+func (ls Labels) Get(name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+// Equal returns whether the two label sets are equal.
+func (ls Labels) Equal(o Labels) bool {
+	if len(ls) != len(o) {
+		return false
+	}
+	for i, l := range ls {
+		if l != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash returns a hash value for the label set that is stable across
+// processes with the same binary.
+func (ls Labels) Hash() uint64 {
+	const prime64 = 1099511628211
+	var h uint64 = 14695981039346656037
+
+	for _, l := range ls {
+		for i := 0; i < len(l.Name); i++ {
+			h ^= uint64(l.Name[i])
+			h *= prime64
+		}
+		h ^= uint64('=')
+		h *= prime64
+		for i := 0; i < len(l.Value); i++ {
+			h ^= uint64(l.Value[i])
+			h *= prime64
+		}
+		h ^= uint64(';')
+		h *= prime64
+	}
+	return h
+}
+
+// New returns a sorted Labels from the given labels.
+func New(ls ...Label) Labels {
+	set := make(Labels, 0, len(ls))
+	set = append(set, ls...)
+	sort.Sort(set)
+	return set
+}
+
+// FromStrings creates new labels from pairs of strings.
+func FromStrings(ss ...string) Labels {
+	if len(ss)%2 != 0 {
+		panic(fmt.Sprintf("invalid number of strings passed to FromStrings: %d", len(ss)))
+	}
+	var res Labels
+	for i := 0; i < len(ss); i += 2 {
+		res = append(res, Label{Name: ss[i], Value: ss[i+1]})
+	}
+	sort.Sort(res)
+	return res
+}
+
+// FromMap returns new sorted Labels from the given map.
+func FromMap(m map[string]string) Labels {
+	l := make([]Label, 0, len(m))
+	for k, v := range m {
+		l = append(l, Label{Name: k, Value: v})
+	}
+	return New(l...)
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import "regexp"
+
+// Matcher checks whether a value for a fixed label name satisfies a
+// condition.
+type Matcher interface {
+	// Name returns the label name the matcher applies to.
+	Name() string
+	// Matches returns whether the matcher applies to the given value.
+	Matches(v string) bool
+}
+
+type equalMatcher struct {
+	name, value string
+}
+
+func (m *equalMatcher) Name() string { return m.name }
+
+func (m *equalMatcher) Matches(v string) bool { return v == m.value }
+
+// Value returns the value an equalMatcher matches against. It lets callers
+// that hold a Matcher as an interface recover the value without depending
+// on the unexported concrete type, e.g. to serve an equality match via a
+// label-value postings lookup instead of a per-series scan.
+func (m *equalMatcher) Value() string { return m.value }
+
+// NewEqualMatcher returns a matcher that matches values equal to value.
+func NewEqualMatcher(name, value string) Matcher {
+	return &equalMatcher{name: name, value: value}
+}
+
+type notMatcher struct {
+	Matcher
+}
+
+func (m *notMatcher) Matches(v string) bool { return !m.Matcher.Matches(v) }
+
+// Unwrap returns the matcher being negated. It lets callers recognize a
+// negated matcher (e.g. produced by NewNotEqualMatcher/NewNotRegexpMatcher)
+// without depending on the unexported notMatcher type.
+func (m *notMatcher) Unwrap() Matcher { return m.Matcher }
+
+// Not inverts the matches of the given matcher.
+func Not(m Matcher) Matcher {
+	return &notMatcher{m}
+}
+
+// NewNotEqualMatcher returns a matcher that matches values not equal to value.
+func NewNotEqualMatcher(name, value string) Matcher {
+	return Not(NewEqualMatcher(name, value))
+}
+
+type regexpMatcher struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func (m *regexpMatcher) Name() string { return m.name }
+
+func (m *regexpMatcher) Matches(v string) bool { return m.re.MatchString(v) }
+
+// Regexp returns the compiled, anchored regexp a regexpMatcher matches
+// against, so callers can evaluate it directly against a sorted list of
+// label values instead of calling Matches per series.
+func (m *regexpMatcher) Regexp() *regexp.Regexp { return m.re }
+
+// NewRegexpMatcher returns a matcher that matches values for which the
+// regexp expr, anchored on both ends, matches.
+func NewRegexpMatcher(name, expr string) (Matcher, error) {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	return &regexpMatcher{name: name, re: re}, nil
+}
+
+// NewNotRegexpMatcher returns a matcher that matches values for which the
+// regexp expr, anchored on both ends, does not match.
+func NewNotRegexpMatcher(name, expr string) (Matcher, error) {
+	m, err := NewRegexpMatcher(name, expr)
+	if err != nil {
+		return nil, err
+	}
+	return Not(m), nil
+}
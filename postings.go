@@ -0,0 +1,630 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Postings provides iterative access over a postings list, i.e. a sorted
+// list of series IDs.
+type Postings interface {
+	// Next advances the iterator and returns true if another value was found.
+	Next() bool
+
+	// Seek advances the iterator to the first value equal or greater than v
+	// and returns true if a value was found.
+	Seek(v uint32) bool
+
+	// At returns the value at the current iterator position.
+	At() uint32
+
+	// Err returns the last error of the iterator.
+	Err() error
+}
+
+// errPostings is an empty postings list that always errors.
+type errPostings struct {
+	err error
+}
+
+func (e errPostings) Next() bool       { return false }
+func (e errPostings) Seek(uint32) bool { return false }
+func (e errPostings) At() uint32       { return 0 }
+func (e errPostings) Err() error       { return e.err }
+
+var emptyPostings = errPostings{}
+
+// EmptyPostings returns a postings list that's always empty.
+func EmptyPostings() Postings {
+	return emptyPostings
+}
+
+// ErrPostings returns postings that immediately error.
+func ErrPostings(err error) Postings {
+	return errPostings{err}
+}
+
+// Intersect returns a new postings list over the intersection of the
+// input postings.
+func Intersect(its ...Postings) Postings {
+	if len(its) == 0 {
+		return emptyPostings
+	}
+	if len(its) == 1 {
+		return its[0]
+	}
+	if allRoaring(its) {
+		if p, ok := intersectRoaring(its); ok {
+			return p
+		}
+	}
+	its = sortBySizeAsc(its)
+
+	l := len(its) / 2
+	return newIntersectPostings(Intersect(its[:l]...), Intersect(its[l:]...))
+}
+
+// sizer is implemented by Postings that can report their remaining
+// cardinality in O(1).
+type sizer interface {
+	Size() int
+}
+
+// sortBySizeAsc returns its reordered by ascending Size(), smallest first,
+// so that a pairwise Intersect tree drives its outer Next loop on the
+// cheapest operand and only Seeks into the larger ones. Operands that don't
+// expose a Size() (e.g. mergedPostings, removedPostings) are treated as
+// unknown/large and pushed to the back, in their original relative order,
+// rather than disabling the reordering for every operand.
+func sortBySizeAsc(its []Postings) []Postings {
+	type sized struct {
+		p Postings
+		n int
+	}
+	list := make([]sized, len(its))
+	for i, p := range its {
+		n := math.MaxInt32
+		if s, ok := p.(sizer); ok {
+			n = s.Size()
+		}
+		list[i] = sized{p, n}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].n < list[j].n })
+
+	out := make([]Postings, len(list))
+	for i, s := range list {
+		out[i] = s.p
+	}
+	return out
+}
+
+type intersectPostings struct {
+	a, b    Postings
+	cur     uint32
+	started bool
+}
+
+func newIntersectPostings(a, b Postings) *intersectPostings {
+	return &intersectPostings{a: a, b: b}
+}
+
+func (it *intersectPostings) At() uint32 {
+	return it.cur
+}
+
+func (it *intersectPostings) doNext(id uint32) bool {
+	for {
+		if !it.b.Seek(id) {
+			return false
+		}
+		if vb := it.b.At(); vb != id {
+			if !it.a.Seek(vb) {
+				return false
+			}
+			id = it.a.At()
+			if vb != id {
+				continue
+			}
+		}
+		it.cur = id
+		return true
+	}
+}
+
+// Next advances past the previously emitted value by re-seeking a,
+// deliberately avoiding a bare it.a.Next() call: doNext may have last
+// positioned a via a.Seek (when catching it up to b), and Seek is the
+// only operation every Postings implementation agrees on the meaning of
+// "positioned, not yet consumed, At() already valid" -- some (like
+// mergedPostings and removedPostings) don't advance past a value a bare
+// Next() call would repeat if driven directly off of it.
+func (it *intersectPostings) Next() bool {
+	next := it.cur
+	if it.started {
+		if next == math.MaxUint32 {
+			return false
+		}
+		next++
+	}
+	it.started = true
+
+	if !it.a.Seek(next) {
+		return false
+	}
+	return it.doNext(it.a.At())
+}
+
+func (it *intersectPostings) Seek(id uint32) bool {
+	if it.started && it.cur >= id {
+		return true
+	}
+
+	if !it.a.Seek(id) {
+		return false
+	}
+	it.started = true
+	return it.doNext(it.a.At())
+}
+
+func (it *intersectPostings) Err() error {
+	if it.a.Err() != nil {
+		return it.a.Err()
+	}
+	return it.b.Err()
+}
+
+// Merge returns a new iterator over the union of the input iterators.
+func Merge(its ...Postings) Postings {
+	if len(its) == 0 {
+		return EmptyPostings()
+	}
+	if len(its) == 1 {
+		return its[0]
+	}
+	if allRoaring(its) {
+		if p, ok := mergeRoaring(its); ok {
+			return p
+		}
+	}
+	its = sortBySizeAsc(its)
+
+	l := len(its) / 2
+	return newMergedPostings(Merge(its[:l]...), Merge(its[l:]...))
+}
+
+type mergedPostings struct {
+	a, b        Postings
+	initialized bool
+	aok, bok    bool
+	cur         uint32
+}
+
+func newMergedPostings(a, b Postings) *mergedPostings {
+	return &mergedPostings{a: a, b: b}
+}
+
+func (it *mergedPostings) At() uint32 {
+	return it.cur
+}
+
+func (it *mergedPostings) Next() bool {
+	if !it.initialized {
+		it.aok = it.a.Next()
+		it.bok = it.b.Next()
+		it.initialized = true
+	}
+
+	if !it.aok && !it.bok {
+		return false
+	}
+
+	if !it.aok {
+		it.cur = it.b.At()
+		it.bok = it.b.Next()
+		return true
+	}
+	if !it.bok {
+		it.cur = it.a.At()
+		it.aok = it.a.Next()
+		return true
+	}
+
+	acur, bcur := it.a.At(), it.b.At()
+
+	if acur < bcur {
+		it.cur = acur
+		it.aok = it.a.Next()
+	} else if acur > bcur {
+		it.cur = bcur
+		it.bok = it.b.Next()
+	} else {
+		it.cur = acur
+		it.aok = it.a.Next()
+		it.bok = it.b.Next()
+	}
+	return true
+}
+
+// Seek advances both operands to the first value >= id and, like every
+// other Postings implementation in this package (listPostings,
+// bigEndianPostings, roaringPostings), leaves that value available via
+// At() immediately -- callers such as intersectPostings.doNext read At()
+// right after Seek with no intervening Next(). It only peeks the merged
+// value though, without consuming it, so a caller that instead goes
+// straight to Next() (as a plain iteration loop would) still sees it as
+// the first result rather than skipping past it.
+func (it *mergedPostings) Seek(id uint32) bool {
+	if it.initialized && it.cur >= id {
+		return true
+	}
+
+	it.aok = it.a.Seek(id)
+	it.bok = it.b.Seek(id)
+	it.initialized = true
+
+	switch {
+	case it.aok && it.bok:
+		it.cur = it.a.At()
+		if bv := it.b.At(); bv < it.cur {
+			it.cur = bv
+		}
+	case it.aok:
+		it.cur = it.a.At()
+	case it.bok:
+		it.cur = it.b.At()
+	default:
+		return false
+	}
+	return true
+}
+
+func (it *mergedPostings) Err() error {
+	if it.a.Err() != nil {
+		return it.a.Err()
+	}
+	return it.b.Err()
+}
+
+// Without returns a new postings list over the values in full that are not
+// also present in exclude.
+func Without(full, exclude Postings) Postings {
+	return newRemovedPostings(full, exclude)
+}
+
+type removedPostings struct {
+	full, remove Postings
+
+	initialized bool
+	fok, rok    bool
+	cur         uint32
+}
+
+func newRemovedPostings(full, remove Postings) *removedPostings {
+	return &removedPostings{full: full, remove: remove}
+}
+
+func (it *removedPostings) At() uint32 {
+	return it.cur
+}
+
+func (it *removedPostings) Next() bool {
+	if !it.initialized {
+		it.fok = it.full.Next()
+		it.rok = it.remove.Next()
+		it.initialized = true
+	}
+
+	for {
+		if !it.fok {
+			return false
+		}
+		if !it.rok {
+			it.cur = it.full.At()
+			it.fok = it.full.Next()
+			return true
+		}
+
+		fcur, rcur := it.full.At(), it.remove.At()
+		switch {
+		case fcur < rcur:
+			it.cur = fcur
+			it.fok = it.full.Next()
+			return true
+		case fcur == rcur:
+			it.fok = it.full.Next()
+			it.rok = it.remove.Next()
+		default:
+			it.rok = it.remove.Seek(fcur)
+		}
+	}
+}
+
+// Seek advances both operands to the first value >= id that isn't
+// excluded, skipping over any excluded run exactly as Next does, but
+// without consuming the match it lands on: At() is valid immediately
+// (matching listPostings, bigEndianPostings, roaringPostings, for callers
+// like intersectPostings.doNext that read it with no intervening Next()),
+// while a caller that instead goes straight to Next() still sees it as
+// the first result rather than skipping past it, matching
+// mergedPostings.Seek's convention.
+func (it *removedPostings) Seek(id uint32) bool {
+	if it.initialized && it.cur >= id {
+		return true
+	}
+
+	it.fok = it.full.Seek(id)
+	it.rok = it.remove.Seek(id)
+	it.initialized = true
+
+	for it.fok && it.rok {
+		fcur, rcur := it.full.At(), it.remove.At()
+		switch {
+		case fcur < rcur:
+			it.cur = fcur
+			return true
+		case fcur == rcur:
+			it.fok = it.full.Next()
+			it.rok = it.remove.Next()
+		default:
+			it.rok = it.remove.Seek(fcur)
+		}
+	}
+	if !it.fok {
+		return false
+	}
+	it.cur = it.full.At()
+	return true
+}
+
+func (it *removedPostings) Err() error {
+	if it.full.Err() != nil {
+		return it.full.Err()
+	}
+	return it.remove.Err()
+}
+
+// listPostings implements the Postings interface over a plain sorted slice.
+type listPostings struct {
+	list []uint32
+	cur  uint32
+	ok   bool // whether cur holds a value a prior Next/Seek actually found
+}
+
+func newListPostings(list []uint32) *listPostings {
+	return &listPostings{list: list}
+}
+
+func (it *listPostings) At() uint32 {
+	return it.cur
+}
+
+// Size returns the number of not-yet-consumed IDs.
+func (it *listPostings) Size() int {
+	return len(it.list)
+}
+
+func (it *listPostings) Next() bool {
+	if len(it.list) > 0 {
+		it.cur = it.list[0]
+		it.list = it.list[1:]
+		it.ok = true
+		return true
+	}
+	it.cur = 0
+	it.ok = false
+	return false
+}
+
+func (it *listPostings) Seek(x uint32) bool {
+	// ok guards this shortcut so a fresh iterator (cur's zero value) isn't
+	// mistaken for already being positioned at 0.
+	if it.ok && it.cur >= x {
+		return true
+	}
+
+	i := sort.Search(len(it.list), func(i int) bool {
+		return it.list[i] >= x
+	})
+	if i < len(it.list) {
+		it.cur = it.list[i]
+		it.list = it.list[i+1:]
+		it.ok = true
+		return true
+	}
+	it.list = nil
+	it.ok = false
+	return false
+}
+
+func (it *listPostings) Err() error {
+	return nil
+}
+
+// bigEndianPostings implements the Postings interface over a byte stream of
+// big endian uint32s.
+type bigEndianPostings struct {
+	list []byte
+	cur  uint32
+	ok   bool // whether cur holds a value a prior Next/Seek actually found
+}
+
+func newBigEndianPostings(list []byte) *bigEndianPostings {
+	return &bigEndianPostings{list: list}
+}
+
+func (it *bigEndianPostings) At() uint32 {
+	return it.cur
+}
+
+// Size returns the number of not-yet-consumed IDs.
+func (it *bigEndianPostings) Size() int {
+	return len(it.list) / 4
+}
+
+func (it *bigEndianPostings) Next() bool {
+	if len(it.list) >= 4 {
+		it.cur = binary.BigEndian.Uint32(it.list)
+		it.list = it.list[4:]
+		it.ok = true
+		return true
+	}
+	it.ok = false
+	return false
+}
+
+// Seek is idempotent: a target at or below the current value leaves the
+// iterator where it is instead of consuming further into the list, same as
+// listPostings.Seek. ok guards this shortcut so a fresh iterator (cur's
+// zero value) isn't mistaken for already being positioned at 0.
+//
+// Otherwise the search is an adaptive gallop: instead of a plain binary
+// search over the whole remaining list, it probes at exponentially
+// increasing offsets (1, 2, 4, 8, ...) until it overshoots x, then
+// binary-searches the much smaller bracket the overshoot landed in. For a
+// target close to the start of a long remaining list -- the common case
+// when a small operand drives Seeks into a much larger one -- this is
+// O(log k) in the distance to the target rather than O(log n) in the
+// list's full remaining length.
+func (it *bigEndianPostings) Seek(x uint32) bool {
+	if it.ok && it.cur >= x {
+		return true
+	}
+
+	num := len(it.list) / 4
+	get := func(i int) uint32 { return binary.BigEndian.Uint32(it.list[i*4:]) }
+
+	i := gallopSearch(num, func(i int) bool { return get(i) >= x })
+	if i < num {
+		j := i * 4
+		it.cur = get(i)
+		it.list = it.list[j+4:]
+		it.ok = true
+		return true
+	}
+	it.list = nil
+	it.ok = false
+	return false
+}
+
+// gallopSearch returns the smallest i in [0,n] such that pred(i) is true,
+// assuming pred is monotonically false-then-true over [0,n). It probes at
+// exponentially increasing offsets before narrowing with sort.Search, so it
+// outperforms a plain binary search when the answer is near the start of a
+// long range.
+func gallopSearch(n int, pred func(int) bool) int {
+	if n == 0 || pred(0) {
+		return 0
+	}
+
+	prev, bound := 0, 1
+	for bound < n && !pred(bound) {
+		prev = bound
+		bound *= 2
+	}
+	if bound > n {
+		bound = n
+	}
+
+	return prev + sort.Search(bound-prev, func(i int) bool { return pred(prev + i) })
+}
+
+func (it *bigEndianPostings) Err() error {
+	return nil
+}
+
+// memPostings holds the postings list for each label pair kept in memory,
+// e.g. by the head block's label index.
+type memPostings struct {
+	mtx sync.RWMutex
+	m   map[labels.Label][]uint32
+}
+
+func newMemPostings() *memPostings {
+	return &memPostings{m: make(map[labels.Label][]uint32, 512)}
+}
+
+// sortedKeys returns the label pairs that have at least one posting,
+// ordered by name then value.
+func (p *memPostings) sortedKeys() []labels.Label {
+	p.mtx.RLock()
+	keys := make([]labels.Label, 0, len(p.m))
+	for l := range p.m {
+		keys = append(keys, l)
+	}
+	p.mtx.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if d := strings.Compare(keys[i].Name, keys[j].Name); d != 0 {
+			return d < 0
+		}
+		return keys[i].Value < keys[j].Value
+	})
+	return keys
+}
+
+// get returns the postings list for the given label pair.
+func (p *memPostings) get(name, value string) Postings {
+	p.mtx.RLock()
+	l := p.m[labels.Label{Name: name, Value: value}]
+	p.mtx.RUnlock()
+
+	if l == nil {
+		return EmptyPostings()
+	}
+	return newListPostings(l)
+}
+
+// add records id under every label of lset, plus the reserved "all series"
+// key so all() can enumerate every series ever added.
+func (p *memPostings) add(id uint32, lset labels.Labels) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, l := range lset {
+		p.m[l] = append(p.m[l], id)
+	}
+	p.m[allPostingsKey] = append(p.m[allPostingsKey], id)
+}
+
+// all returns a postings list over every series ever added.
+func (p *memPostings) all() Postings {
+	return p.get(allPostingsKey.Name, allPostingsKey.Value)
+}
+
+// labelValues returns the sorted, distinct values recorded for name, so a
+// regex matcher can be evaluated against them instead of against every
+// series individually.
+func (p *memPostings) labelValues(name string) []string {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	var vals []string
+	for l := range p.m {
+		if l.Name == name {
+			vals = append(vals, l.Value)
+		}
+	}
+	sort.Strings(vals)
+	return vals
+}
+
+var allPostingsKey = labels.Label{}
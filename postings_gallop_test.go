@@ -0,0 +1,98 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encodeBigEndian(ids []uint32) []byte {
+	b := make([]byte, len(ids)*4)
+	for i, id := range ids {
+		binary.BigEndian.PutUint32(b[i*4:], id)
+	}
+	return b
+}
+
+func TestGallopSearch(t *testing.T) {
+	ls := []uint32{2, 4, 4, 8, 16, 32, 64, 65, 66, 1000}
+
+	for _, c := range []struct {
+		x    uint32
+		want int
+	}{
+		{x: 0, want: 0},
+		{x: 2, want: 0},
+		{x: 5, want: 3},
+		{x: 64, want: 6},
+		{x: 67, want: 9},
+		{x: 1001, want: len(ls)},
+	} {
+		got := gallopSearch(len(ls), func(i int) bool { return ls[i] >= c.x })
+		require.Equal(t, c.want, got, "x=%d", c.x)
+	}
+}
+
+func TestBigEndianSize(t *testing.T) {
+	ids := []uint32{1, 2, 3, 4, 5}
+	p := newBigEndianPostings(encodeBigEndian(ids))
+	require.Equal(t, len(ids), p.Size())
+
+	p.Next()
+	p.Next()
+	require.Equal(t, len(ids)-2, p.Size())
+}
+
+// BenchmarkIntersectSkewed reuses BenchmarkIntersect's heavily skewed
+// workload (one sparse operand, one dense one) but built from
+// bigEndianPostings, to show the effect of galloping Seek plus
+// cardinality-ascending operand ordering over the plain binary-search
+// version exercised by BenchmarkIntersect.
+func BenchmarkIntersectSkewed(t *testing.B) {
+	var a, b, c, d []uint32
+
+	for i := 0; i < 10000000; i += 2 {
+		a = append(a, uint32(i))
+	}
+	for i := 5000000; i < 5000100; i += 4 {
+		b = append(b, uint32(i))
+	}
+	for i := 5090000; i < 5090600; i += 4 {
+		b = append(b, uint32(i))
+	}
+	for i := 4990000; i < 5100000; i++ {
+		c = append(c, uint32(i))
+	}
+	for i := 4000000; i < 6000000; i++ {
+		d = append(d, uint32(i))
+	}
+
+	ea, eb, ec, ed := encodeBigEndian(a), encodeBigEndian(b), encodeBigEndian(c), encodeBigEndian(d)
+
+	t.ResetTimer()
+
+	for i := 0; i < t.N; i++ {
+		i1 := newBigEndianPostings(ea)
+		i2 := newBigEndianPostings(eb)
+		i3 := newBigEndianPostings(ec)
+		i4 := newBigEndianPostings(ed)
+
+		if _, err := expandPostings(Intersect(i1, i2, i3, i4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestIntersectWithMergedOperand guards against a regression where
+// Intersect, when one of its operands is a *mergedPostings (or
+// *removedPostings), could hang forever: intersectPostings.doNext reads
+// At() on an operand right after Seek with no intervening Next(), which
+// used to see a stale cur and never make progress.
+func TestIntersectWithMergedOperand(t *testing.T) {
+	merged := newMergedPostings(
+		newListPostings([]uint32{1, 2, 3, 7, 9}),
+		newListPostings([]uint32{4, 5, 6, 8}),
+	)
+
+	done := make(chan []uint32, 1)
+	go func() {
+		res, err := expandPostings(Intersect(merged, newListPostings([]uint32{2, 3, 5, 7, 8, 9})))
+		require.NoError(t, err)
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		require.Equal(t, []uint32{2, 3, 5, 7, 8, 9}, res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Intersect with a mergedPostings operand did not terminate")
+	}
+}
+
+// TestIntersectWithRemovedOperand is the same regression test for
+// *removedPostings (the Without result), which has the identical Seek
+// contract as mergedPostings.
+func TestIntersectWithRemovedOperand(t *testing.T) {
+	removed := Without(
+		newListPostings([]uint32{1, 2, 3, 4, 5, 6, 7, 8, 9}),
+		newListPostings([]uint32{2, 5, 8}),
+	)
+
+	done := make(chan []uint32, 1)
+	go func() {
+		res, err := expandPostings(Intersect(removed, newListPostings([]uint32{3, 4, 6, 7, 9})))
+		require.NoError(t, err)
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		require.Equal(t, []uint32{3, 4, 6, 7, 9}, res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Intersect with a removedPostings operand did not terminate")
+	}
+}
+
+// TestIntersectSeekIsIdempotent guards against a regression where
+// intersectPostings.Seek, like bigEndianPostings.Seek, lost data on a
+// second Seek with a non-increasing target: without its own cur-based
+// shortcut, re-seeking to an already-passed value re-searched from the
+// current position and skipped past the value actually at that position.
+func TestIntersectSeekIsIdempotent(t *testing.T) {
+	a := newBigEndianPostings(encodeBigEndian([]uint32{10, 20, 30, 40, 50}))
+	b := newBigEndianPostings(encodeBigEndian([]uint32{10, 20, 30, 40, 50}))
+	p := Intersect(a, b)
+
+	require.True(t, p.Seek(20))
+	require.Equal(t, uint32(20), p.At())
+
+	require.True(t, p.Seek(15))
+	require.Equal(t, uint32(20), p.At())
+}
@@ -0,0 +1,524 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// The roaring postings format partitions the 32-bit ID space into 64k-wide
+// "buckets" (the high 16 bits of an ID select the bucket). Each bucket is
+// stored as whichever of two containers is smaller:
+//
+//   - a sorted array of the low 16 bits of every ID in the bucket, used
+//     when the bucket holds few IDs (<= roaringArrayMaxCardinality), or
+//   - a dense 8 KiB bitmap with one bit per possible low-16-bit value,
+//     used once the bucket is dense enough that the array would be
+//     larger than the bitmap.
+//
+// This mirrors the container layout used by Roaring bitmaps elsewhere in
+// the TSDB ecosystem (m3db, and more recent Prometheus blocks) to keep
+// high-cardinality label postings compact while still supporting fast
+// container-level set operations.
+const (
+	roaringContainerArray  byte = 0
+	roaringContainerBitmap byte = 1
+
+	// roaringArrayMaxCardinality is the largest bucket cardinality stored
+	// as a sorted uint16 array. Above this, a bitmap container (fixed at
+	// roaringBitmapBytes) is smaller.
+	roaringArrayMaxCardinality = 4096
+
+	// roaringBitmapWords/roaringBitmapBytes is the size of a dense bitmap
+	// container: one bit per low-16-bit value, i.e. 8 KiB.
+	roaringBitmapWords = 1 << 16 / 64
+	roaringBitmapBytes = roaringBitmapWords * 8
+)
+
+// roaringBucket describes one decoded container within a roaringPostings
+// byte slice.
+type roaringBucket struct {
+	key  uint16
+	kind byte
+	data []byte // 2 bytes per ID (at most roaringArrayMaxCardinality*2) for an array, roaringBitmapBytes for a bitmap
+}
+
+// roaringPostings implements Postings over the roaring on-disk format
+// described above.
+type roaringPostings struct {
+	buckets []roaringBucket
+
+	bi  int // index of the current bucket
+	pos int // position within the current bucket's container
+	cur uint32
+}
+
+// newRoaringPostings parses b, the on-disk representation produced by
+// roaringPostingsWriter, into a Postings implementation.
+//
+// Layout:
+//
+//	4 bytes  bucket count (big endian uint32)
+//	for each bucket, ascending by key:
+//	  2 bytes  bucket key (big endian uint16)
+//	  1 byte   container kind
+//	  4 bytes  container length (big endian uint32)
+//	  ...      container bytes
+func newRoaringPostings(b []byte) *roaringPostings {
+	if len(b) < 4 {
+		return &roaringPostings{}
+	}
+	n := binary.BigEndian.Uint32(b)
+	b = b[4:]
+
+	buckets := make([]roaringBucket, 0, n)
+	for i := uint32(0); i < n; i++ {
+		key := binary.BigEndian.Uint16(b)
+		kind := b[2]
+		length := binary.BigEndian.Uint32(b[3:])
+		b = b[7:]
+		buckets = append(buckets, roaringBucket{key: key, kind: kind, data: b[:length]})
+		b = b[length:]
+	}
+	return &roaringPostings{buckets: buckets, bi: -1, pos: -1}
+}
+
+func (p *roaringPostings) At() uint32 {
+	return p.cur
+}
+
+// Size returns the total number of IDs encoded, for use when ordering
+// postings operands by estimated cardinality.
+func (p *roaringPostings) Size() int {
+	n := 0
+	for _, b := range p.buckets {
+		n += bucketCardinality(b)
+	}
+	return n
+}
+
+func bucketCardinality(b roaringBucket) int {
+	if b.kind == roaringContainerArray {
+		return len(b.data) / 2
+	}
+	n := 0
+	for i := 0; i+8 <= len(b.data); i += 8 {
+		n += bits.OnesCount64(binary.BigEndian.Uint64(b.data[i:]))
+	}
+	return n
+}
+
+func (p *roaringPostings) Next() bool {
+	for {
+		if p.bi < 0 {
+			p.bi = 0
+			p.pos = -1
+		}
+		if p.bi >= len(p.buckets) {
+			return false
+		}
+		b := p.buckets[p.bi]
+
+		if ok, low := nextInBucket(b, p.pos); ok {
+			p.pos = int(low)
+			p.cur = uint32(b.key)<<16 | uint32(low)
+			return true
+		}
+		p.bi++
+		p.pos = -1
+	}
+}
+
+// nextInBucket returns the smallest low-16-bit value in b strictly greater
+// than after (pass -1 to start from the beginning), plus whether one was
+// found.
+func nextInBucket(b roaringBucket, after int) (bool, uint16) {
+	switch b.kind {
+	case roaringContainerArray:
+		n := len(b.data) / 2
+		i := sort.Search(n, func(i int) bool {
+			return int(binary.BigEndian.Uint16(b.data[i*2:])) > after
+		})
+		if i < n {
+			return true, binary.BigEndian.Uint16(b.data[i*2:])
+		}
+		return false, 0
+	case roaringContainerBitmap:
+		start := after + 1
+		for w := start / 64; w*8+8 <= len(b.data); w++ {
+			word := binary.BigEndian.Uint64(b.data[w*8:])
+			if w*64 < start {
+				// Mask off bits at or before `after` within the first word.
+				word &^= (uint64(1) << uint(start-w*64)) - 1
+			}
+			if word != 0 {
+				return true, uint16(w*64 + bits.TrailingZeros64(word))
+			}
+		}
+		return false, 0
+	}
+	return false, 0
+}
+
+func (p *roaringPostings) Seek(x uint32) bool {
+	// p.bi < len(p.buckets) distinguishes "positioned at a real value"
+	// from "exhausted": Next/Seek set p.bi to len(p.buckets), which is
+	// still >= 0, once the iterator runs out.
+	if p.cur >= x && p.bi >= 0 && p.bi < len(p.buckets) {
+		return true
+	}
+	key, low := uint16(x>>16), int(uint16(x))
+
+	i := sort.Search(len(p.buckets), func(i int) bool { return p.buckets[i].key >= key })
+	if i == len(p.buckets) {
+		p.bi = len(p.buckets)
+		return false
+	}
+
+	p.bi, p.pos = i, -1
+	if p.buckets[i].key == key {
+		p.pos = low - 1
+	}
+	return p.Next()
+}
+
+func (p *roaringPostings) Err() error {
+	return nil
+}
+
+// roaringPostingsWriter accumulates sorted IDs and encodes them into the
+// roaring postings format, picking the smaller container for each bucket.
+type roaringPostingsWriter struct {
+	keys    []uint16
+	buckets map[uint16][]uint16
+}
+
+func newRoaringPostingsWriter() *roaringPostingsWriter {
+	return &roaringPostingsWriter{buckets: make(map[uint16][]uint16)}
+}
+
+// Add records id. IDs must be added in ascending order.
+func (w *roaringPostingsWriter) Add(id uint32) {
+	key, low := uint16(id>>16), uint16(id)
+	if _, ok := w.buckets[key]; !ok {
+		w.keys = append(w.keys, key)
+	}
+	w.buckets[key] = append(w.buckets[key], low)
+}
+
+// Bytes returns the encoded roaring postings list.
+func (w *roaringPostingsWriter) Bytes() []byte {
+	out := make([]byte, 4)
+	binary.BigEndian.PutUint32(out, uint32(len(w.keys)))
+
+	for _, key := range w.keys {
+		lows := w.buckets[key]
+		kind, data := encodeContainer(lows)
+
+		hdr := make([]byte, 7)
+		binary.BigEndian.PutUint16(hdr, key)
+		hdr[2] = kind
+		binary.BigEndian.PutUint32(hdr[3:], uint32(len(data)))
+
+		out = append(out, hdr...)
+		out = append(out, data...)
+	}
+	return out
+}
+
+func encodeContainer(lows []uint16) (byte, []byte) {
+	if len(lows) <= roaringArrayMaxCardinality {
+		data := make([]byte, len(lows)*2)
+		for i, v := range lows {
+			binary.BigEndian.PutUint16(data[i*2:], v)
+		}
+		return roaringContainerArray, data
+	}
+
+	data := make([]byte, roaringBitmapBytes)
+	for _, v := range lows {
+		w := v / 64
+		word := binary.BigEndian.Uint64(data[w*8:])
+		word |= uint64(1) << (v % 64)
+		binary.BigEndian.PutUint64(data[w*8:], word)
+	}
+	return roaringContainerBitmap, data
+}
+
+// EncodeRoaringPostings encodes a sorted slice of IDs into the roaring
+// postings format understood by newRoaringPostings.
+func EncodeRoaringPostings(ids []uint32) []byte {
+	w := newRoaringPostingsWriter()
+	for _, id := range ids {
+		w.Add(id)
+	}
+	return w.Bytes()
+}
+
+// allRoaring reports whether every operand is a *roaringPostings, which
+// unlocks the container-level fast paths below.
+func allRoaring(its []Postings) bool {
+	for _, p := range its {
+		if _, ok := p.(*roaringPostings); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// intersectRoaring computes the intersection of N roaring postings lists
+// bucket by bucket, doing a container-level AND instead of driving the
+// generic Seek/Next iterator protocol.
+func intersectRoaring(its []Postings) (Postings, bool) {
+	rs := make([]*roaringPostings, len(its))
+	for i, p := range its {
+		rs[i] = p.(*roaringPostings)
+	}
+
+	w := newRoaringPostingsWriter()
+	for _, key := range commonBucketKeys(rs) {
+		cur, _ := bucketFor(rs[0], key)
+
+		for _, r := range rs[1:] {
+			b, ok := bucketFor(r, key)
+			if !ok {
+				cur = roaringBucket{}
+				break
+			}
+			cur = intersectBuckets(cur, b)
+			if bucketCardinality(cur) == 0 {
+				break
+			}
+		}
+		addBucket(w, cur)
+	}
+	return newRoaringPostings(w.Bytes()), true
+}
+
+// mergeRoaring computes the union of N roaring postings lists bucket by
+// bucket, doing a container-level OR instead of driving the generic
+// iterator protocol.
+func mergeRoaring(its []Postings) (Postings, bool) {
+	rs := make([]*roaringPostings, len(its))
+	for i, p := range its {
+		rs[i] = p.(*roaringPostings)
+	}
+
+	w := newRoaringPostingsWriter()
+	for _, key := range allBucketKeys(rs) {
+		var cur roaringBucket
+		has := false
+		for _, r := range rs {
+			b, ok := bucketFor(r, key)
+			if !ok {
+				continue
+			}
+			if !has {
+				cur, has = b, true
+				continue
+			}
+			cur = unionBuckets(cur, b)
+		}
+		addBucket(w, cur)
+	}
+	return newRoaringPostings(w.Bytes()), true
+}
+
+func bucketFor(r *roaringPostings, key uint16) (roaringBucket, bool) {
+	i := sort.Search(len(r.buckets), func(i int) bool { return r.buckets[i].key >= key })
+	if i < len(r.buckets) && r.buckets[i].key == key {
+		return r.buckets[i], true
+	}
+	return roaringBucket{}, false
+}
+
+func commonBucketKeys(rs []*roaringPostings) []uint16 {
+	if len(rs) == 0 {
+		return nil
+	}
+	var keys []uint16
+	for _, b := range rs[0].buckets {
+		inAll := true
+		for _, r := range rs[1:] {
+			if _, ok := bucketFor(r, b.key); !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			keys = append(keys, b.key)
+		}
+	}
+	return keys
+}
+
+func allBucketKeys(rs []*roaringPostings) []uint16 {
+	seen := map[uint16]bool{}
+	var keys []uint16
+	for _, r := range rs {
+		for _, b := range r.buckets {
+			if !seen[b.key] {
+				seen[b.key] = true
+				keys = append(keys, b.key)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// intersectBuckets ANDs two containers for the same key. A bitmap/bitmap
+// pair is ANDed a word at a time; any pairing involving an array container
+// is driven by iterating that array (at most roaringArrayMaxCardinality
+// elements) and testing membership in the other side, so cost never scales
+// with a bitmap operand's cardinality.
+func intersectBuckets(a, b roaringBucket) roaringBucket {
+	if a.kind == roaringContainerBitmap && b.kind == roaringContainerBitmap {
+		data := make([]byte, roaringBitmapBytes)
+		for i := 0; i < len(data); i += 8 {
+			av := binary.BigEndian.Uint64(a.data[i:])
+			bv := binary.BigEndian.Uint64(b.data[i:])
+			binary.BigEndian.PutUint64(data[i:], av&bv)
+		}
+		return roaringBucket{key: a.key, kind: roaringContainerBitmap, data: data}
+	}
+	if a.kind == roaringContainerArray && b.kind == roaringContainerArray {
+		lows := intersectSorted(decodeArray(a), decodeArray(b))
+		_, data := encodeContainer(lows)
+		return roaringBucket{key: a.key, kind: roaringContainerArray, data: data}
+	}
+
+	arr, bm := a, b
+	if arr.kind != roaringContainerArray {
+		arr, bm = b, a
+	}
+	var out []uint16
+	for _, v := range decodeArray(arr) {
+		if bitmapTest(bm.data, v) {
+			out = append(out, v)
+		}
+	}
+	_, data := encodeContainer(out)
+	return roaringBucket{key: a.key, kind: roaringContainerArray, data: data}
+}
+
+// unionBuckets ORs two containers for the same key. If either side is a
+// bitmap the result is built as a bitmap (a union is never sparser than its
+// densest operand); two arrays stay an array via a sorted merge.
+func unionBuckets(a, b roaringBucket) roaringBucket {
+	if a.kind != roaringContainerBitmap && b.kind != roaringContainerBitmap {
+		lows := unionSorted(decodeArray(a), decodeArray(b))
+		kind, data := encodeContainer(lows)
+		return roaringBucket{key: a.key, kind: kind, data: data}
+	}
+
+	data := make([]byte, roaringBitmapBytes)
+	for _, src := range [2]roaringBucket{a, b} {
+		if src.kind == roaringContainerBitmap {
+			for i := 0; i < len(data); i += 8 {
+				ov := binary.BigEndian.Uint64(data[i:])
+				sv := binary.BigEndian.Uint64(src.data[i:])
+				binary.BigEndian.PutUint64(data[i:], ov|sv)
+			}
+			continue
+		}
+		for _, v := range decodeArray(src) {
+			w := v / 64
+			word := binary.BigEndian.Uint64(data[w*8:])
+			word |= uint64(1) << (v % 64)
+			binary.BigEndian.PutUint64(data[w*8:], word)
+		}
+	}
+	return roaringBucket{key: a.key, kind: roaringContainerBitmap, data: data}
+}
+
+// addBucket feeds every member of a decoded bucket into w by walking its
+// container directly (the same scan Next uses) rather than materializing
+// the set as an intermediate slice.
+func addBucket(w *roaringPostingsWriter, b roaringBucket) {
+	if b.data == nil {
+		return
+	}
+	pos := -1
+	for {
+		ok, low := nextInBucket(b, pos)
+		if !ok {
+			return
+		}
+		w.Add(uint32(b.key)<<16 | uint32(low))
+		pos = int(low)
+	}
+}
+
+func decodeArray(b roaringBucket) []uint16 {
+	n := len(b.data) / 2
+	out := make([]uint16, n)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint16(b.data[i*2:])
+	}
+	return out
+}
+
+func bitmapTest(data []byte, v uint16) bool {
+	word := binary.BigEndian.Uint64(data[(v/64)*8:])
+	return word>>(v%64)&1 != 0
+}
+
+func intersectSorted(a, b []uint16) []uint16 {
+	if a == nil {
+		return nil
+	}
+	var out []uint16
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func unionSorted(a, b []uint16) []uint16 {
+	if a == nil {
+		return append([]uint16(nil), b...)
+	}
+	out := make([]uint16, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			out = append(out, a[i])
+			i++
+		case a[i] > b[j]:
+			out = append(out, b[j])
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	out = append(out, a[i:]...)
+	out = append(out, b[j:]...)
+	return out
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoaringPostings(t *testing.T) {
+	var cases = []struct {
+		ids []uint32
+	}{
+		{ids: nil},
+		{ids: []uint32{0}},
+		{ids: []uint32{1, 2, 3, 70000, 70001, 1 << 20}},
+		{ids: denseRange(100000, 105000)}, // dense enough in its bucket to force a bitmap container
+	}
+
+	for _, c := range cases {
+		p := newRoaringPostings(EncodeRoaringPostings(c.ids))
+		res, err := expandPostings(p)
+		require.NoError(t, err)
+		require.Equal(t, c.ids, res)
+	}
+}
+
+func TestRoaringPostingsSeek(t *testing.T) {
+	ids := append(denseRange(0, 5000), []uint32{70000, 70005, 1 << 20}...)
+	p := newRoaringPostings(EncodeRoaringPostings(ids))
+
+	require.True(t, p.Seek(4999))
+	require.Equal(t, uint32(4999), p.At())
+
+	require.True(t, p.Seek(70000))
+	require.Equal(t, uint32(70000), p.At())
+
+	require.True(t, p.Seek(70001))
+	require.Equal(t, uint32(70005), p.At())
+
+	require.False(t, p.Seek(1<<20+1))
+}
+
+// TestRoaringPostingsSeekAfterExhaustion guards against a regression where,
+// once a Seek exhausted the iterator (bi advanced to len(buckets)), a later
+// Seek with a smaller target incorrectly short-circuited on the stale cur
+// instead of re-searching, fabricating a match at the old position rather
+// than reporting the real one.
+func TestRoaringPostingsSeekAfterExhaustion(t *testing.T) {
+	ids := append(denseRange(0, 5000), []uint32{70000, 70005, 1 << 20}...)
+	p := newRoaringPostings(EncodeRoaringPostings(ids))
+
+	require.True(t, p.Seek(70005))
+	require.Equal(t, uint32(70005), p.At())
+
+	require.False(t, p.Seek(1<<20+1))
+
+	require.True(t, p.Seek(5))
+	require.Equal(t, uint32(5), p.At())
+}
+
+func TestRoaringIntersectAndMerge(t *testing.T) {
+	a := append(denseRange(0, 5000), uint32(70000))
+	b := append(denseRange(2500, 7500), uint32(70000))
+
+	pa := newRoaringPostings(EncodeRoaringPostings(a))
+	pb := newRoaringPostings(EncodeRoaringPostings(b))
+
+	inter, ok := intersectRoaring([]Postings{pa, pb})
+	require.True(t, ok)
+	res, err := expandPostings(inter)
+	require.NoError(t, err)
+	require.Equal(t, append(denseRange(2500, 5000), uint32(70000)), res)
+
+	pa = newRoaringPostings(EncodeRoaringPostings(a))
+	pb = newRoaringPostings(EncodeRoaringPostings(b))
+
+	union, ok := mergeRoaring([]Postings{pa, pb})
+	require.True(t, ok)
+	res, err = expandPostings(union)
+	require.NoError(t, err)
+	require.Equal(t, append(denseRange(0, 7500), uint32(70000)), res)
+}
+
+func TestIntersectMergeDispatchToRoaring(t *testing.T) {
+	a := newRoaringPostings(EncodeRoaringPostings([]uint32{1, 2, 3, 70000}))
+	b := newRoaringPostings(EncodeRoaringPostings([]uint32{2, 3, 4, 70000}))
+
+	res, err := expandPostings(Intersect(a, b))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2, 3, 70000}, res)
+
+	a = newRoaringPostings(EncodeRoaringPostings([]uint32{1, 2}))
+	b = newRoaringPostings(EncodeRoaringPostings([]uint32{2, 3}))
+
+	res, err = expandPostings(Merge(a, b))
+	require.NoError(t, err)
+	require.Equal(t, []uint32{1, 2, 3}, res)
+}
+
+func denseRange(from, to uint32) []uint32 {
+	res := make([]uint32, 0, to-from)
+	for i := from; i < to; i++ {
+		res = append(res, i)
+	}
+	return res
+}
+
+// BenchmarkIntersectRoaring mirrors BenchmarkIntersect's skewed workload --
+// one very sparse operand (b) and one very dense one (d) -- but built from
+// roaring postings, to compare against the generic iterator path.
+func BenchmarkIntersectRoaring(t *testing.B) {
+	var a, b, c, d []uint32
+
+	for i := 0; i < 10000000; i += 2 {
+		a = append(a, uint32(i))
+	}
+	for i := 5000000; i < 5000100; i += 4 {
+		b = append(b, uint32(i))
+	}
+	for i := 5090000; i < 5090600; i += 4 {
+		b = append(b, uint32(i))
+	}
+	for i := 4990000; i < 5100000; i++ {
+		c = append(c, uint32(i))
+	}
+	for i := 4000000; i < 6000000; i++ {
+		d = append(d, uint32(i))
+	}
+
+	ea, eb, ec, ed := EncodeRoaringPostings(a), EncodeRoaringPostings(b), EncodeRoaringPostings(c), EncodeRoaringPostings(d)
+
+	t.ResetTimer()
+
+	for i := 0; i < t.N; i++ {
+		i1 := newRoaringPostings(ea)
+		i2 := newRoaringPostings(eb)
+		i3 := newRoaringPostings(ec)
+		i4 := newRoaringPostings(ed)
+
+		if _, err := expandPostings(Intersect(i1, i2, i3, i4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -290,19 +290,22 @@ func TestBigEndian(t *testing.T) {
 				ls[500] - 1, ls[500], true,
 			},
 			{
+				// Seek is idempotent: repeating the same (or a smaller)
+				// target leaves the iterator on the value it already
+				// found instead of consuming further into the list.
 				ls[600] + 1, ls[601], true,
 			},
 			{
-				ls[600] + 1, ls[602], true,
+				ls[600] + 1, ls[601], true,
 			},
 			{
-				ls[600] + 1, ls[603], true,
+				ls[600] + 1, ls[601], true,
 			},
 			{
-				ls[0], ls[604], true,
+				ls[0], ls[601], true,
 			},
 			{
-				ls[600], ls[605], true,
+				ls[600], ls[601], true,
 			},
 			{
 				ls[999], ls[999], true,
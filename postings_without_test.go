@@ -0,0 +1,75 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithout(t *testing.T) {
+	var cases = []struct {
+		full, exclude []uint32
+		res           []uint32
+	}{
+		{
+			// Empty exclude leaves full untouched.
+			full:    []uint32{1, 2, 3, 4, 5},
+			exclude: nil,
+			res:     []uint32{1, 2, 3, 4, 5},
+		},
+		{
+			// exclude a superset of full.
+			full:    []uint32{2, 4, 6},
+			exclude: []uint32{1, 2, 3, 4, 5, 6, 7},
+			res:     nil,
+		},
+		{
+			// Interleaved runs of excluded and kept values.
+			full:    []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			exclude: []uint32{2, 3, 6, 7, 8},
+			res:     []uint32{1, 4, 5, 9, 10},
+		},
+		{
+			// exclude has values not present in full; should be skipped
+			// over rather than tripping up the merge.
+			full:    []uint32{10, 20, 30},
+			exclude: []uint32{5, 15, 20, 25},
+			res:     []uint32{10, 30},
+		},
+	}
+
+	for _, c := range cases {
+		full := newListPostings(c.full)
+		exclude := newListPostings(c.exclude)
+
+		res, err := expandPostings(Without(full, exclude))
+		require.NoError(t, err)
+		require.Equal(t, c.res, res)
+	}
+}
+
+func TestWithoutSeek(t *testing.T) {
+	full := newListPostings([]uint32{1, 2, 3, 4, 5, 6, 7, 8})
+	exclude := newListPostings([]uint32{2, 4, 6, 8})
+
+	p := Without(full, exclude)
+
+	require.True(t, p.Seek(3))
+
+	res, err := expandPostings(p)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{3, 5, 7}, res)
+}
@@ -0,0 +1,397 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"regexp"
+
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+)
+
+// Querier provides querying access over time series data of a fixed time
+// range.
+type Querier interface {
+	// Select returns a set of series that matches the given label matchers.
+	Select(...labels.Matcher) SeriesSet
+
+	// SelectChunks returns, for every series matching the given label
+	// matchers, its raw encoded chunks overlapping the querier's time
+	// range -- with no decompression -- for zero-copy consumers such as a
+	// remote-read handler. Select is implemented on top of this.
+	SelectChunks(...labels.Matcher) ChunkSeriesSet
+
+	// Close releases the resources of the Querier.
+	Close() error
+}
+
+// sample is a single timestamp/value pair produced by a SeriesIterator.
+type sample struct {
+	t int64
+	v float64
+}
+
+// Series exposes a single time series.
+type Series interface {
+	// Labels returns the complete set of labels identifying the series.
+	Labels() labels.Labels
+
+	// Iterator returns a new iterator over the data of the series.
+	Iterator() SeriesIterator
+}
+
+// SeriesSet contains a set of series.
+type SeriesSet interface {
+	Next() bool
+	At() Series
+	Err() error
+}
+
+// ChunkMeta describes one raw, encoded chunk of a series: the time range it
+// covers and its on-disk bytes, exactly as stored -- never decompressed.
+type ChunkMeta struct {
+	MinTime, MaxTime int64
+	Encoding         chunks.Encoding
+	Chunk            []byte
+}
+
+// ChunkSeries exposes a single time series as a sequence of raw chunks
+// rather than decoded samples.
+type ChunkSeries interface {
+	// Labels returns the complete set of labels identifying the series.
+	Labels() labels.Labels
+
+	// Iterator returns a new iterator over the series' chunks.
+	Iterator() ChunkIterator
+}
+
+// ChunkSeriesSet contains a set of chunk series.
+type ChunkSeriesSet interface {
+	Next() bool
+	At() ChunkSeries
+	Err() error
+}
+
+// ChunkIterator iterates over the raw chunks of a time series.
+type ChunkIterator interface {
+	// Next advances the iterator and returns true if another chunk was
+	// found.
+	Next() bool
+	// At returns the current chunk.
+	At() ChunkMeta
+	// Err returns the current error.
+	Err() error
+}
+
+// SeriesIterator iterates over the data of a time series.
+type SeriesIterator interface {
+	// Seek advances the iterator forward to the first sample with a
+	// timestamp equal or greater than t.
+	Seek(t int64) bool
+	// At returns the current timestamp/value pair.
+	At() (t int64, v float64)
+	// Next advances the iterator by one.
+	Next() bool
+	// Err returns the current error.
+	Err() error
+}
+
+type headQuerier struct {
+	head       *Head
+	mint, maxt int64
+}
+
+// Querier returns a new Querier over the head for the given time range.
+func (h *Head) Querier(mint, maxt int64) Querier {
+	return &headQuerier{head: h, mint: mint, maxt: maxt}
+}
+
+func (q *headQuerier) Close() error { return nil }
+
+// Select returns decoded series built on top of SelectChunks: the raw
+// chunks it yields are run through a decoding adapter and clipped to the
+// querier's time range.
+func (q *headQuerier) Select(ms ...labels.Matcher) SeriesSet {
+	return &chunkDecodingSeriesSet{css: q.SelectChunks(ms...), mint: q.mint, maxt: q.maxt}
+}
+
+// SelectChunks narrows the candidate series down via the postings index for
+// whichever matchers it can accelerate (equality, negation, regexp), then
+// snapshots the raw, still-encoded chunk of every matching series that
+// overlaps the querier's time range. The snapshot is a defensive copy taken
+// under the series' lock, so it is unaffected by samples appended after
+// this call returns.
+func (q *headQuerier) SelectChunks(ms ...labels.Matcher) ChunkSeriesSet {
+	matched := q.matchedSeries(ms)
+
+	series := make([]*memChunkSeries, 0, len(matched))
+	for _, s := range matched {
+		cm, ok := s.chunkMeta()
+		if !ok || cm.MaxTime < q.mint || cm.MinTime > q.maxt {
+			continue
+		}
+		series = append(series, &memChunkSeries{lset: s.lset, chunks: []ChunkMeta{cm}})
+	}
+	return &memChunkSeriesSet{series: series, i: -1}
+}
+
+// matchedSeries resolves ms to postings where possible and returns every
+// head series whose label set satisfies all of ms.
+func (q *headQuerier) matchedSeries(ms []labels.Matcher) []*memSeries {
+	q.head.mtx.RLock()
+	defer q.head.mtx.RUnlock()
+
+	p := q.head.postings.all()
+	var accelerated []Postings
+	for _, m := range ms {
+		if ap, ok := postingsForMatcher(q.head, m); ok {
+			accelerated = append(accelerated, ap)
+		}
+	}
+	if len(accelerated) > 0 {
+		p = Intersect(accelerated...)
+	}
+
+	var matched []*memSeries
+	for p.Next() {
+		s := q.head.series[p.At()]
+		if s == nil {
+			continue
+		}
+		if seriesMatches(s.lset, ms) {
+			matched = append(matched, s)
+		}
+	}
+	return matched
+}
+
+// postingsForMatcher resolves m to a postings list using the head's label
+// index, without touching any series, when m is one of the shapes the
+// index can serve directly: equality, its negation, a regexp, or a negated
+// regexp. It reports false when m can't be accelerated this way, in which
+// case the caller falls back to scanning every series.
+func postingsForMatcher(head *Head, m labels.Matcher) (Postings, bool) {
+	switch t := m.(type) {
+	case interface{ Unwrap() labels.Matcher }:
+		p, ok := postingsForMatcher(head, t.Unwrap())
+		if !ok {
+			return nil, false
+		}
+		return Without(head.postings.all(), p), true
+	case interface{ Value() string }:
+		if t.Value() == "" {
+			// memPostings never holds a {name: ""} entry for missing
+			// labels, so the index can't tell "no series have this
+			// label" from "no series have this value" -- fall back to
+			// the full per-series scan, which Labels.Get/Matches
+			// handles correctly for an absent label.
+			return nil, false
+		}
+		return head.postings.get(m.Name(), t.Value()), true
+	case interface{ Regexp() *regexp.Regexp }:
+		if t.Regexp().MatchString("") {
+			// As with Value() == "" above: series lacking the label match
+			// too, but have no postings entry under it.
+			return nil, false
+		}
+		return regexpPostings(head, m.Name(), t.Regexp()), true
+	}
+	return nil, false
+}
+
+// regexpPostings evaluates re against the sorted list of values recorded
+// for name and merges the per-value postings of every match, rather than
+// running re against every series' label set.
+func regexpPostings(head *Head, name string, re *regexp.Regexp) Postings {
+	var matched []Postings
+	for _, v := range head.postings.labelValues(name) {
+		if re.MatchString(v) {
+			matched = append(matched, head.postings.get(name, v))
+		}
+	}
+	if len(matched) == 0 {
+		return EmptyPostings()
+	}
+	return Merge(matched...)
+}
+
+func seriesMatches(lset labels.Labels, ms []labels.Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches(lset.Get(m.Name())) {
+			return false
+		}
+	}
+	return true
+}
+
+// memChunkSeriesSet is the ChunkSeriesSet backing SelectChunks: a plain
+// slice of already-snapshotted chunk series.
+type memChunkSeriesSet struct {
+	series []*memChunkSeries
+	i      int
+}
+
+func (s *memChunkSeriesSet) Next() bool {
+	s.i++
+	return s.i < len(s.series)
+}
+
+func (s *memChunkSeriesSet) At() ChunkSeries { return s.series[s.i] }
+
+func (s *memChunkSeriesSet) Err() error { return nil }
+
+// memChunkSeries is a ChunkSeries backed by an already-snapshotted list of
+// a series' chunks.
+type memChunkSeries struct {
+	lset   labels.Labels
+	chunks []ChunkMeta
+}
+
+func (s *memChunkSeries) Labels() labels.Labels { return s.lset }
+
+func (s *memChunkSeries) Iterator() ChunkIterator {
+	return &chunkMetaIterator{chunks: s.chunks, i: -1}
+}
+
+// chunkMetaIterator iterates over a fixed, already-snapshotted slice of
+// ChunkMeta.
+type chunkMetaIterator struct {
+	chunks []ChunkMeta
+	i      int
+}
+
+func (it *chunkMetaIterator) Next() bool {
+	it.i++
+	return it.i < len(it.chunks)
+}
+
+func (it *chunkMetaIterator) At() ChunkMeta { return it.chunks[it.i] }
+
+func (it *chunkMetaIterator) Err() error { return nil }
+
+// chunkDecodingSeriesSet adapts a ChunkSeriesSet to SeriesSet by decoding
+// each series' raw chunks and clipping the result to [mint, maxt]. This is
+// the code Select shares with SelectChunks.
+type chunkDecodingSeriesSet struct {
+	css        ChunkSeriesSet
+	mint, maxt int64
+}
+
+func (s *chunkDecodingSeriesSet) Next() bool { return s.css.Next() }
+
+func (s *chunkDecodingSeriesSet) At() Series {
+	return &chunkDecodingSeries{cs: s.css.At(), mint: s.mint, maxt: s.maxt}
+}
+
+func (s *chunkDecodingSeriesSet) Err() error { return s.css.Err() }
+
+// chunkDecodingSeries adapts a ChunkSeries to Series by decoding its raw
+// chunks on demand.
+type chunkDecodingSeries struct {
+	cs         ChunkSeries
+	mint, maxt int64
+}
+
+func (s *chunkDecodingSeries) Labels() labels.Labels { return s.cs.Labels() }
+
+func (s *chunkDecodingSeries) Iterator() SeriesIterator {
+	return &boundedIterator{it: &chunkDecodingIterator{it: s.cs.Iterator()}, mint: s.mint, maxt: s.maxt}
+}
+
+// chunkDecodingIterator concatenates the decoded samples of every chunk a
+// ChunkIterator yields into a single sample stream.
+type chunkDecodingIterator struct {
+	it  ChunkIterator
+	cur chunks.Iterator
+	err error
+}
+
+func (it *chunkDecodingIterator) Next() bool {
+	for {
+		if it.cur != nil && it.cur.Next() {
+			return true
+		}
+		if !it.it.Next() {
+			it.err = it.it.Err()
+			return false
+		}
+		cm := it.it.At()
+		c, err := chunks.FromData(cm.Encoding, cm.Chunk)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.cur = c.Iterator()
+	}
+}
+
+func (it *chunkDecodingIterator) At() (int64, float64) { return it.cur.At() }
+
+func (it *chunkDecodingIterator) Err() error { return it.err }
+
+// boundedIterator clips an underlying chunk iterator to [mint, maxt].
+type boundedIterator struct {
+	it interface {
+		Next() bool
+		At() (int64, float64)
+		Err() error
+	}
+	mint, maxt int64
+}
+
+func (b *boundedIterator) Next() bool {
+	for b.it.Next() {
+		t, _ := b.it.At()
+		if t < b.mint {
+			continue
+		}
+		if t > b.maxt {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (b *boundedIterator) Seek(t int64) bool {
+	if t < b.mint {
+		t = b.mint
+	}
+	for b.Next() {
+		ct, _ := b.it.At()
+		if ct >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *boundedIterator) At() (int64, float64) {
+	return b.it.At()
+}
+
+func (b *boundedIterator) Err() error {
+	return b.it.Err()
+}
+
+type emptySeriesSet struct{}
+
+func (emptySeriesSet) Next() bool { return false }
+func (emptySeriesSet) At() Series { return nil }
+func (emptySeriesSet) Err() error { return nil }
+
+// EmptySeriesSet returns a series set that's always empty.
+func EmptySeriesSet() SeriesSet {
+	return emptySeriesSet{}
+}
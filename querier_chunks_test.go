@@ -0,0 +1,137 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/stretchr/testify/require"
+)
+
+// readChunkSeriesSet drains a ChunkSeriesSet into a map of series name to
+// the ChunkMeta of every chunk of that series, for easy comparison in tests.
+func readChunkSeriesSet(css ChunkSeriesSet) (map[string][]ChunkMeta, error) {
+	result := map[string][]ChunkMeta{}
+
+	for css.Next() {
+		series := css.At()
+
+		var metas []ChunkMeta
+		it := series.Iterator()
+		for it.Next() {
+			metas = append(metas, it.At())
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		result[series.Labels().String()] = metas
+		if err := css.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func TestSelectChunksAvailableOnlyAfterCommit(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+
+	querier := db.Querier(0, 10)
+	defer querier.Close()
+	chunkSet, err := readChunkSeriesSet(querier.SelectChunks(labels.NewEqualMatcher("foo", "bar")))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]ChunkMeta{}, chunkSet)
+
+	require.NoError(t, app.Commit())
+
+	querier = db.Querier(0, 10)
+	defer querier.Close()
+
+	chunkSet, err = readChunkSeriesSet(querier.SelectChunks(labels.NewEqualMatcher("foo", "bar")))
+	require.NoError(t, err)
+
+	metas := chunkSet[`{foo="bar"}`]
+	require.Len(t, metas, 1)
+	require.Equal(t, int64(0), metas[0].MinTime)
+	require.Equal(t, int64(0), metas[0].MaxTime)
+	require.Equal(t, chunks.EncXOR, metas[0].Encoding)
+}
+
+// TestSelectChunksIsImmutableSnapshot asserts that appending more samples
+// to a series after SelectChunks has already returned a ChunkMeta for it
+// does not change the bytes of that already-returned ChunkMeta -- the
+// defensive-copy guarantee chunkMeta provides.
+func TestSelectChunksIsImmutableSnapshot(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	ref, err := app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	querier := db.Querier(0, 100)
+	defer querier.Close()
+
+	chunkSet, err := readChunkSeriesSet(querier.SelectChunks(labels.NewEqualMatcher("foo", "bar")))
+	require.NoError(t, err)
+	before := append([]byte(nil), chunkSet[`{foo="bar"}`][0].Chunk...)
+
+	app2 := db.Appender()
+	require.NoError(t, app2.AddFast(ref, 1, 1))
+	require.NoError(t, app2.Commit())
+
+	require.Equal(t, before, chunkSet[`{foo="bar"}`][0].Chunk)
+}
+
+func TestSelectDelegatesToSelectChunks(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 1, 1)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	querier := db.Querier(0, 1)
+	defer querier.Close()
+
+	seriesSet, err := readSeriesSet(querier.Select(labels.NewEqualMatcher("foo", "bar")))
+	require.NoError(t, err)
+	require.Equal(t, map[string][]sample{
+		`{foo="bar"}`: {{t: 0, v: 0}, {t: 1, v: 1}},
+	}, seriesSet)
+}
@@ -0,0 +1,189 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bytesPerSample approximates the wire size of a single (timestamp, value)
+// pair -- an 8-byte int64 plus an 8-byte float64, before chunk compression
+// -- used only to turn a sample count into a byte-rate estimate for
+// IngestStats.
+const bytesPerSample = 16
+
+// refillInterval is the fixed tick at which a RateLimiter's token bucket is
+// topped up, per the classic token-bucket design: a small, steady refill
+// cadence rather than computing continuous elapsed-time credit.
+const refillInterval = 100 * time.Millisecond
+
+// emaAlpha weights the most recent refillInterval's observed rate against
+// the running average exposed by IngestStats.
+const emaAlpha = 0.3
+
+// RateLimiter is a token-bucket limiter guarding sample ingestion. Tokens
+// are refilled on a fixed refillInterval tick of a time.Ticker, each tick
+// adding rate*refillInterval regardless of the time actually elapsed, and
+// it tracks an EMA of the effective admission rate for IngestStats.
+type RateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	mtx    sync.Mutex
+	tokens float64
+
+	statsMtx               sync.Mutex
+	lastSamples, lastBytes int64
+	emaRate, emaBytes      float64
+
+	// sampleCount and byteCount are signed so release (back out a rolled-
+	// back batch's contribution) can subtract past a refill tick that
+	// already observed them without wrapping around like an unsigned
+	// counter would.
+	sampleCount int64 // atomic
+	byteCount   int64 // atomic
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRateLimiter returns a RateLimiter admitting up to rate samples/second,
+// allowing bursts of up to burst samples above that steady rate. The
+// bucket starts full.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	rl := &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		stop:   make(chan struct{}),
+	}
+	rl.wg.Add(1)
+	go rl.run()
+	return rl
+}
+
+func (rl *RateLimiter) run() {
+	defer rl.wg.Done()
+
+	ticker := time.NewTicker(refillInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rl.refill()
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
+func (rl *RateLimiter) refill() {
+	rl.mtx.Lock()
+	rl.tokens += rl.rate * refillInterval.Seconds()
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.mtx.Unlock()
+
+	dt := refillInterval.Seconds()
+	samples := atomic.LoadInt64(&rl.sampleCount)
+	bytes := atomic.LoadInt64(&rl.byteCount)
+
+	rl.statsMtx.Lock()
+	instRate := float64(samples-rl.lastSamples) / dt
+	instBytes := float64(bytes-rl.lastBytes) / dt
+	if instRate < 0 {
+		// A release landing in the window after the refill tick that
+		// already counted its samples can make this delta go negative;
+		// IngestStats is a gauge, so clamp rather than let a transient
+		// rollback burst report a negative ingestion rate.
+		instRate = 0
+		instBytes = 0
+	}
+	rl.lastSamples, rl.lastBytes = samples, bytes
+	rl.emaRate = emaAlpha*instRate + (1-emaAlpha)*rl.emaRate
+	rl.emaBytes = emaAlpha*instBytes + (1-emaAlpha)*rl.emaBytes
+	rl.statsMtx.Unlock()
+}
+
+// tryTake attempts to take n tokens without blocking, reporting whether it
+// succeeded.
+func (rl *RateLimiter) tryTake(n float64) bool {
+	rl.mtx.Lock()
+	if rl.tokens < n {
+		rl.mtx.Unlock()
+		return false
+	}
+	rl.tokens -= n
+	rl.mtx.Unlock()
+
+	atomic.AddInt64(&rl.sampleCount, int64(n))
+	atomic.AddInt64(&rl.byteCount, int64(n)*bytesPerSample)
+	return true
+}
+
+// wait blocks until n tokens are available or ctx is done.
+func (rl *RateLimiter) wait(ctx context.Context, n float64) error {
+	if rl.tryTake(n) {
+		return nil
+	}
+	poll := time.NewTicker(refillInterval / 10)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+			if rl.tryTake(n) {
+				return nil
+			}
+		}
+	}
+}
+
+// release returns n tokens to the bucket, e.g. after a batch that took them
+// is rolled back, and backs the same n samples out of the counters Stats
+// derives its rate from -- tryTake already counted them as ingested by the
+// time a caller can roll the batch back, so without this IngestStats would
+// permanently over-report for any workload with rollbacks.
+func (rl *RateLimiter) release(n float64) {
+	rl.mtx.Lock()
+	rl.tokens += n
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.mtx.Unlock()
+
+	atomic.AddInt64(&rl.sampleCount, -int64(n))
+	atomic.AddInt64(&rl.byteCount, -int64(n)*bytesPerSample)
+}
+
+// Stats returns the EMA of the admitted sample rate (samples/s) and the
+// corresponding estimated byte rate.
+func (rl *RateLimiter) Stats() (rate, bytes float64) {
+	rl.statsMtx.Lock()
+	defer rl.statsMtx.Unlock()
+	return rl.emaRate, rl.emaBytes
+}
+
+// Close stops the limiter's background refill goroutine.
+func (rl *RateLimiter) Close() {
+	close(rl.stop)
+	rl.wg.Wait()
+}
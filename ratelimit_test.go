@@ -0,0 +1,237 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/tsdb/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterTryTake(t *testing.T) {
+	rl := NewRateLimiter(10, 2)
+	defer rl.Close()
+
+	require.True(t, rl.tryTake(1))
+	require.True(t, rl.tryTake(1))
+	require.False(t, rl.tryTake(1), "burst of 2 should be exhausted")
+
+	rl.release(1)
+	require.True(t, rl.tryTake(1), "a released token should be available again")
+}
+
+func TestRateLimiterWaitBlocksUntilRefill(t *testing.T) {
+	rl := NewRateLimiter(1000, 1) // refills fast enough for a short test
+	defer rl.Close()
+
+	require.True(t, rl.tryTake(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	require.NoError(t, rl.wait(ctx, 1))
+	require.True(t, time.Since(start) > 0)
+}
+
+func TestRateLimiterWaitRespectsContext(t *testing.T) {
+	rl := NewRateLimiter(0, 0) // never refills
+	defer rl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := rl.wait(ctx, 1)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDBAppenderThrottled(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, &Options{
+		RateLimitMode:    RateLimitThrottle,
+		SamplesPerSecond: 0,
+		Burst:            1,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+
+	_, err = app.Add(labels.FromStrings("foo", "baz"), 1, 1)
+	require.Equal(t, ErrThrottled, err)
+}
+
+// TestRateLimiterStatsExcludesReleasedSamples guards against a regression
+// where release returned tokens to the bucket but left sampleCount/
+// byteCount -- the counters refill derives the IngestStats EMA from --
+// permanently inflated, so a workload that's entirely Add-then-Rollback
+// cycles would report a nonzero ingestion rate despite nothing ever being
+// durably committed.
+func TestRateLimiterStatsExcludesReleasedSamples(t *testing.T) {
+	rl := NewRateLimiter(0, 100)
+	defer rl.Close()
+
+	for i := 0; i < 50; i++ {
+		require.True(t, rl.tryTake(1))
+		rl.release(1)
+	}
+
+	rl.refill()
+
+	rate, bytes := rl.Stats()
+	require.Zero(t, rate)
+	require.Zero(t, bytes)
+}
+
+// TestRateLimiterStatsNeverNegative guards against a regression where a
+// release's counter decrement landing in a later refill window than its
+// matching tryTake's increment made the window's delta negative -- without
+// clamping, IngestStats could report a negative ingestion rate, which
+// doesn't make sense for a value documented as a Prometheus gauge.
+func TestRateLimiterStatsNeverNegative(t *testing.T) {
+	rl := NewRateLimiter(0, 100)
+	defer rl.Close()
+
+	require.True(t, rl.tryTake(5))
+	rl.refill() // lastSamples/lastBytes now include the 5 just taken
+
+	rl.release(5) // sampleCount/byteCount drop back below lastSamples/lastBytes
+	rl.refill()   // this window's delta would be negative without clamping
+
+	rate, bytes := rl.Stats()
+	require.True(t, rate >= 0, "rate should never go negative, got %v", rate)
+	require.True(t, bytes >= 0, "bytes should never go negative, got %v", bytes)
+}
+
+func TestDBAppenderRollbackRestoresTokens(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, &Options{
+		RateLimitMode:    RateLimitThrottle,
+		SamplesPerSecond: 0,
+		Burst:            1,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, app.Rollback())
+
+	// The rolled-back batch's token should be back in the bucket.
+	app = db.Appender()
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+}
+
+// TestDBIngestStatsExcludesRolledBackSamples is the DB-level counterpart to
+// TestRateLimiterStatsExcludesReleasedSamples: a workload that only ever
+// rolls its batches back should settle back to a zero reported rate once
+// the limiter's background refill has had a chance to run, not stay
+// permanently inflated by samples that were never durably committed.
+func TestDBIngestStatsExcludesRolledBackSamples(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, &Options{
+		RateLimitMode:    RateLimitBlock,
+		SamplesPerSecond: 1000,
+		Burst:            10,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		app := db.Appender()
+		_, err := app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+		require.NoError(t, err)
+		require.NoError(t, app.Rollback())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	var rate float64
+	for time.Now().Before(deadline) {
+		rate, _ = db.IngestStats()
+		if rate == 0 {
+			return
+		}
+		time.Sleep(refillInterval)
+	}
+	t.Fatalf("IngestStats never settled back to zero, last rate=%v", rate)
+}
+
+// TestDBAppenderAddCtxRespectsCallerContext asserts that a blocking Add can
+// be bounded by a per-call context, independent of the DB's own lifetime
+// context -- Add/AddFast alone only ever respect the latter, since they're
+// canceled solely by DB.Close.
+func TestDBAppenderAddCtxRespectsCallerContext(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, &Options{
+		RateLimitMode:    RateLimitBlock,
+		SamplesPerSecond: 0, // never refills
+		Burst:            1,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.Add(labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = app.AddCtx(ctx, labels.FromStrings("foo", "baz"), 1, 1)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+// TestDBAppenderAddCtxNilContext asserts a nil ctx falls back to the DB's
+// own lifetime context instead of panicking.
+func TestDBAppenderAddCtxNilContext(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "test")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, nil, nil, &Options{
+		RateLimitMode:    RateLimitBlock,
+		SamplesPerSecond: 1000,
+		Burst:            1,
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	app := db.Appender()
+	_, err = app.AddCtx(nil, labels.FromStrings("foo", "bar"), 0, 0)
+	require.NoError(t, err)
+
+	// The burst is spent, so this call has to wait for a refill, which is
+	// the path where the nil ctx is replaced by the DB's context.
+	_, err = app.AddCtx(nil, labels.FromStrings("foo", "baz"), 1, 1)
+	require.NoError(t, err)
+}